@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operators maps each operator's username to their password
+type Operators map[string]string
+
+// ParseOperators reads operators from a comma separated list of
+// username:password pairs
+func ParseOperators(v string) Operators {
+	ops := make(Operators)
+	for _, pair := range strings.Split(v, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+			ops[parts[0]] = parts[1]
+		}
+	}
+	return ops
+}
+
+// Authenticate returns the operator making the request, or "" if the request
+// does not carry valid credentials
+func (ops Operators) Authenticate(r *http.Request) string {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return ""
+	}
+
+	expected, ok := ops[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return ""
+	}
+
+	return username
+}
+
+// AdminHandlerFunc handles a request made by an authenticated operator
+type AdminHandlerFunc func(w http.ResponseWriter, r *http.Request, operator string)
+
+// Require only passes on requests that carry valid operator credentials
+func (ops Operators) Require(h AdminHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		operator := ops.Authenticate(r)
+		if operator == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="EtherDirect admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h(w, r, operator)
+	}
+}
+
+// RefundReviewHandler lists the refunds waiting for review on GET, and records
+// an operator's decision on POST with the form values id, action (approve or
+// decline), fee in pence and note
+func RefundReviewHandler(q *Queue) AdminHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, operator string) {
+		switch r.Method {
+		case "GET":
+			orders, err := q.ledger.List()
+			if err != nil {
+				log.Println(err.Error())
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			pending := []Order{}
+			for _, o := range orders {
+				if o.State == OrderRefundReview {
+					pending = append(pending, o)
+				}
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(pending)
+
+		case "POST":
+			d := RefundDecision{
+				Action:   r.FormValue("action"),
+				Operator: operator,
+				Note:     r.FormValue("note"),
+			}
+
+			if fee := r.FormValue("fee"); fee != "" {
+				var err error
+				d.FeePence, err = strconv.Atoi(fee)
+				if err != nil {
+					http.Error(w, "Invalid fee", http.StatusBadRequest)
+					return
+				}
+			}
+
+			err := q.ReviewRefund(r.FormValue("id"), d)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			log.Printf("Operator %s chose to %s refund of order %s", operator, d.Action, r.FormValue("id"))
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+type PriceGuardStatus struct {
+	Halt      *Halt
+	Reference float64
+}
+
+// PriceGuardHandler shows whether trading is halted on GET, and resumes
+// trading on POST, draining the orders that were waiting
+func PriceGuardHandler(q *Queue, guard *PriceGuard) AdminHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, operator string) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(PriceGuardStatus{
+				Halt:      guard.Halted(),
+				Reference: guard.Reference(time.Now()),
+			})
+
+		case "POST":
+			err := guard.Reset(operator)
+			if err != nil {
+				log.Println(err.Error())
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			go q.Drain()
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// MaintenanceHandler shows whether trading is paused on GET, and pauses or
+// resumes trading on POST with the form values action (pause or resume) and
+// reason
+func MaintenanceHandler(q *Queue, m *Maintenance) AdminHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, operator string) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(m.Paused())
+
+		case "POST":
+			var err error
+			switch r.FormValue("action") {
+			case "pause":
+				if r.FormValue("reason") == "" {
+					http.Error(w, "A reason is required", http.StatusBadRequest)
+					return
+				}
+				err = m.Pause(operator, r.FormValue("reason"), time.Now())
+			case "resume":
+				err = m.Resume(operator)
+			default:
+				http.Error(w, "Invalid action", http.StatusBadRequest)
+				return
+			}
+
+			if err != nil {
+				log.Println(err.Error())
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			q.CheckMaintenance()
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// HeldOrdersHandler lists the held orders on GET, and releases one on POST
+// with the form values id, action (fulfil, refund or cancel) and note
+func HeldOrdersHandler(q *Queue) AdminHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, operator string) {
+		switch r.Method {
+		case "GET":
+			orders, err := q.ledger.List()
+			if err != nil {
+				log.Println(err.Error())
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			held := []Order{}
+			for _, o := range orders {
+				if o.State == OrderHeld {
+					held = append(held, o)
+				}
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(held)
+
+		case "POST":
+			release := HoldRelease{
+				Action:   r.FormValue("action"),
+				Operator: operator,
+				Note:     r.FormValue("note"),
+			}
+
+			err := q.ReleaseHeld(r.FormValue("id"), release)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			log.Printf("Operator %s chose to %s held order %s", operator, release.Action, r.FormValue("id"))
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// IBank pays money out of our account to a customer's bank account
+type IBank interface {
+	CreatePayee(name string, sortCode string, accountNumber string) (payeeId string, err error)
+	Pay(payment BankPayment) (paymentId string, err error)
+}
+
+type BankPayment struct {
+	PayeeId     string `json:"payee_id"`
+	AmountPence int    `json:"amount"`
+	Currency    string `json:"currency"`
+	Reference   string `json:"reference"`
+
+	// Paying twice with the same key only makes one payment
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+type bankPayee struct {
+	Name          string `json:"name"`
+	SortCode      string `json:"sort_code"`
+	AccountNumber string `json:"account_number"`
+}
+
+type bankResult struct {
+	Id string `json:"id"`
+}
+
+// HttpBank talks to a bank's payments API
+type HttpBank struct {
+	root  string
+	token string
+}
+
+func (b *HttpBank) CreatePayee(name string, sortCode string, accountNumber string) (string, error) {
+	result := bankResult{}
+	err := b.post("payees", bankPayee{Name: name, SortCode: sortCode, AccountNumber: accountNumber}, &result)
+	return result.Id, err
+}
+
+func (b *HttpBank) Pay(payment BankPayment) (string, error) {
+	result := bankResult{}
+	err := b.post("payments", payment, &result)
+	return result.Id, err
+}
+
+// post sends a request to the API. Failures that may succeed if retried are
+// Transient, everything else is Permanent.
+func (b *HttpBank) post(path string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return Permanent(err)
+	}
+
+	req, err := http.NewRequest("POST", b.root+path, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Transient(errors.New("Failed to reach bank: " + err.Error()))
+	}
+	defer rsp.Body.Close()
+
+	switch {
+	case rsp.StatusCode == http.StatusOK || rsp.StatusCode == http.StatusCreated:
+	case rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode >= 500:
+		return Transient(fmt.Errorf("Bank %s request failed: %s", path, rsp.Status))
+	default:
+		return Permanent(fmt.Errorf("Bank %s request failed: %s", path, rsp.Status))
+	}
+
+	decoder := json.NewDecoder(rsp.Body)
+	err = decoder.Decode(result)
+	if err != nil {
+		return Permanent(errors.New("Failed to parse response: " + err.Error()))
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRefundIsPaidOutByBank(t *testing.T) {
+	subject, monzo, _, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	api := &FakeBankApi{Token: "token", FailPayments: 2}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	subject.logic.bank = &HttpBank{root: server.URL + "/", token: "token"}
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	order := newTestOrder("tx_refund")
+	order.SetError(CustomerError(ReasonUnknownAccessCode, "Unknown access code"))
+	monzo.SetTransaction(order.Transaction)
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(order.Id)
+	subject.Wait()
+
+	o := waitForState(t, subject.ledger, order.Id, OrderRefunded)
+
+	if o.RefundPaymentId == "" || o.RefundReference != ReasonUnknownAccessCode {
+		t.Errorf("payment %s reference %s", o.RefundPaymentId, o.RefundReference)
+	}
+
+	payment, ok := api.Payments["refund-"+order.Id]
+	if len(api.Payments) != 1 || !ok || payment.AmountPence != 1000 {
+		t.Errorf("payments %v", api.Payments)
+	}
+
+	if payee := api.Payees[o.RefundPayeeId]; payee.SortCode != "123456" || payee.AccountNumber != "123456789" {
+		t.Errorf("payee %v", payee)
+	}
+
+	if monzo.Pots["refund"] != 0 {
+		t.Errorf("refund pot %d", monzo.Pots["refund"])
+	}
+}
+
+func TestRefundRejectedByBankIsHeld(t *testing.T) {
+	subject, monzo, _, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	server := httptest.NewServer(&FakeBankApi{Token: "token"})
+	defer server.Close()
+	subject.logic.bank = &HttpBank{root: server.URL + "/", token: "wrong"}
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	order := newTestOrder("tx_refundrejected")
+	order.SetError(CustomerError(ReasonInvalidAmount, "Invalid amount"))
+	monzo.SetTransaction(order.Transaction)
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(order.Id)
+	subject.Wait()
+
+	o := waitForState(t, subject.ledger, order.Id, OrderHeld)
+
+	if o.Incident == "" || o.RefundPaymentId != "" {
+		t.Errorf("incident '%s' payment '%s'", o.Incident, o.RefundPaymentId)
+	}
+}
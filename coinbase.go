@@ -6,19 +6,104 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	eth "github.com/ethereum/go-ethereum/common"
 	coinbase "github.com/preichenberger/go-gdax"
 )
 
 type ICoinbase interface {
-	BuyEther() (err error, filledSize float64)
-	SendEther(amount string, to eth.Address) error
-	GetEtherPrice() (float64, error)
+	// BuyEther buys Ether at the market price and waits for the order to
+	// finish. If it does not finish in time the error is transient and the
+	// fill carries the order's ID so that GetFill can wait for it again.
+	BuyEther(p EtherPurchase) (err error, fill Fill)
+
+	// GetFill waits for an order placed by BuyEther to finish
+	GetFill(orderId string) (err error, fill Fill)
+
+	// SellEther sells Ether at the market price and reports how much was sold
+	// and what it raised after fees
+	SellEther(size Wei) (err error, soldSize Wei, proceedsPence int)
+
+	// SendEther withdraws Ether to a customer's address and returns the
+	// withdrawal's ID. The withdrawal may still fail after it has been made.
+	// A SendRejectedError means no withdrawal was made, any other error means
+	// one may have been.
+	SendEther(amount Wei, to eth.Address) (withdrawalId string, err error)
+
+	// FindWithdrawal returns the ID of a withdrawal of the amount to the
+	// address made since the given time, or an empty ID if there is none
+	FindWithdrawal(amount Wei, to eth.Address, since time.Time) (withdrawalId string, err error)
+
+	// GetWithdrawal reports how a withdrawal made by SendEther is going
+	GetWithdrawal(id string) (Withdrawal, error)
+
+	// GetEtherPrice returns the price in GBP per Ether that spending the given
+	// amount would buy at, including the exchange's fees
+	GetEtherPrice(amountPence int) (float64, error)
+
+	// GetEtherBalance returns the Ether available to send or trade
+	GetEtherBalance() (Wei, error)
+
+	// GetMarket returns the best bid and ask and the depth of the book
+	GetMarket() (Market, error)
+}
+
+// EtherPurchase is either an amount of GBP to spend or an amount of Ether to buy
+type EtherPurchase struct {
+	FundsPence int
+	Size       Wei
+}
+
+func (p EtherPurchase) String() string {
+	if p.Size.Sign() > 0 {
+		return p.Size.Ether() + " ETH"
+	}
+	return fmt.Sprintf("£%d.%02d worth of ETH", p.FundsPence/100, p.FundsPence%100)
+}
+
+// Fill is what a market order on Coinbase did. An order is finished once its
+// status is done, either because it was filled or because it was cancelled,
+// possibly after being partly filled.
+type Fill struct {
+	OrderId    string
+	Status     string
+	DoneReason string
+	Size       Wei
+	ValuePence int
+	FeesPence  int
+}
+
+func (f Fill) Done() bool {
+	return f.Status == "done"
+}
+
+// CostPence is what Ether bought by the order cost including fees
+func (f Fill) CostPence() int {
+	return f.ValuePence + f.FeesPence
+}
+
+const (
+	WithdrawalPending   = "pending"
+	WithdrawalCompleted = "completed"
+	WithdrawalFailed    = "failed"
+)
+
+// Withdrawal is how sending Ether to a customer is going. The transaction hash
+// and fee are only known once it has completed.
+type Withdrawal struct {
+	Id     string
+	Status string
+	TxHash string
+	Fee    Wei
 }
 
 type Coinbase struct {
 	client *coinbase.Client
+
+	// The exchange's fee on market orders
+	takerFeePercent float64
 }
 
 func (c *Coinbase) Init() {
@@ -26,67 +111,356 @@ func (c *Coinbase) Init() {
 		os.Getenv("CoinbaseSecret"),
 		os.Getenv("CoinbaseKey"),
 		os.Getenv("CoinbasePassphrase"))
-}
 
-func (c *Coinbase) BuyEther() (err error, filledSize float64) {
-	log.Printf("Buy £%d worth of ETH on coinbase", EtherValueGBP)
+	c.takerFeePercent = CoinbaseTakerFeePercent
+	if v := os.Getenv("CoinbaseTakerFeePercent"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			panic(err)
+		}
+		c.takerFeePercent = f
+	}
+}
 
-	// return nil, 0.1
+func (c *Coinbase) BuyEther(p EtherPurchase) (err error, fill Fill) {
+	log.Printf("Buy %s on coinbase", p)
 
 	order := coinbase.Order{
 		Type:      "market",
 		Side:      "buy",
 		ProductId: "ETH-GBP",
-		Funds:     fmt.Sprintf("%d.00", EtherValueGBP),
+	}
+
+	if p.Size.Sign() > 0 {
+		// Coinbase only takes sizes to 8 decimal places
+		order.Size = p.Size.RoundUp(CoinbaseSizeDecimals).Ether()
+	} else {
+		order.Funds = fmt.Sprintf("%d.%02d", p.FundsPence/100, p.FundsPence%100)
 	}
 
 	result, err := c.client.CreateOrder(&order)
 	if err != nil {
-		return errors.New("Failed to buy Ether on Coinbase: " + err.Error()), 0
+		return errors.New("Failed to buy Ether on Coinbase: " + err.Error()), Fill{}
+	}
+
+	return c.GetFill(result.Id)
+}
+
+func (c *Coinbase) GetFill(orderId string) (err error, fill Fill) {
+	o, err := WaitForOrder(c.client.GetOrder, orderId, CoinbaseOrderPollInterval, CoinbaseOrderTimeout)
+	if err != nil {
+		return err, Fill{OrderId: orderId, Status: o.Status}
+	}
+
+	fill, err = FillFromOrder(o)
+	if err != nil {
+		// Leave the fill unfinished so it is read again
+		return err, Fill{OrderId: orderId}
+	}
+
+	if fill.Size.Sign() == 0 {
+		return Transient(fmt.Errorf("Coinbase order %s was %s without buying any Ether", orderId, fill.DoneReason)), fill
+	}
+	if fill.DoneReason != "filled" {
+		log.Printf("Coinbase order %s was %s after buying %s ETH", orderId, fill.DoneReason, fill.Size.Ether())
+	}
+
+	return nil, fill
+}
+
+func (c *Coinbase) SellEther(size Wei) (err error, soldSize Wei, proceedsPence int) {
+	log.Printf("Sell %s ETH on coinbase", size.Ether())
+
+	// Never sell more than we were asked to
+	order := coinbase.Order{
+		Type:      "market",
+		Side:      "sell",
+		ProductId: "ETH-GBP",
+		Size:      size.RoundDown(CoinbaseSizeDecimals).Ether(),
+	}
+
+	result, err := c.client.CreateOrder(&order)
+	if err != nil {
+		return errors.New("Failed to sell Ether on Coinbase: " + err.Error()), Wei{}, 0
+	}
+
+	executedOrder, err := WaitForOrder(c.client.GetOrder, result.Id, CoinbaseOrderPollInterval, CoinbaseOrderTimeout)
+	if err != nil {
+		return err, Wei{}, 0
+	}
+
+	fill, err := FillFromOrder(executedOrder)
+	if err != nil {
+		return err, Wei{}, 0
+	}
+
+	return nil, fill.Size, fill.ValuePence - fill.FeesPence
+}
+
+// ParseCoinbaseTime reads the times on Coinbase transfers, which look like
+// 2019-06-18 01:37:48.78953+00
+func ParseCoinbaseTime(s string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02 15:04:05.999999-07", s)
+	if err != nil {
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	return t, nil
+}
+
+// WithdrawalFromTransfer reads how a withdrawal is going from Coinbase's
+// record of the transfer
+func WithdrawalFromTransfer(t CoinbaseTransfer) (Withdrawal, error) {
+	w := Withdrawal{Id: t.Id, Status: WithdrawalPending}
+
+	switch {
+	case t.CanceledAt != "":
+		w.Status = WithdrawalFailed
+	case t.CompletedAt != "":
+		w.Status = WithdrawalCompleted
+		w.TxHash = t.Details.CryptoTransactionHash
+
+		var err error
+		w.Fee, err = ParseEther(zeroIfEmpty(t.Details.Fee))
+		if err != nil {
+			return w, errors.New("Failed to parse withdrawal fee: " + err.Error())
+		}
+	}
+
+	return w, nil
+}
+
+// WaitForOrder polls an order until it is done. A market order is usually done
+// within a second, but until then its filled size and value are incomplete.
+func WaitForOrder(getOrder func(id string) (coinbase.Order, error), id string, interval time.Duration, timeout time.Duration) (coinbase.Order, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		o, err := getOrder(id)
+		if err == nil && o.Status == "done" {
+			return o, nil
+		}
+
+		if time.Now().After(deadline) {
+			if err != nil {
+				return o, Transient(fmt.Errorf("Failed to get Coinbase order %s: %s", id, err.Error()))
+			}
+			return o, Transient(fmt.Errorf("Coinbase order %s still %s after %s", id, o.Status, timeout))
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// FillFromOrder reads what a finished order did
+func FillFromOrder(o coinbase.Order) (Fill, error) {
+	fill := Fill{
+		OrderId:    o.Id,
+		Status:     o.Status,
+		DoneReason: o.DoneReason,
+	}
+
+	var err error
+
+	fill.Size, err = ParseEther(zeroIfEmpty(o.FilledSize))
+	if err != nil {
+		return fill, errors.New("Failed to parse filled size: " + err.Error())
 	}
 
-	executedOrder, err := c.client.GetOrder(result.Id)
+	fill.ValuePence, err = ParsePence(zeroIfEmpty(o.ExecutedValue))
+	if err != nil {
+		return fill, errors.New("Failed to parse executed value: " + err.Error())
+	}
 
-	f, err := strconv.ParseFloat(executedOrder.FilledSize, 64)
+	fill.FeesPence, err = ParsePence(zeroIfEmpty(o.FillFees))
 	if err != nil {
-		return err, 0
+		return fill, errors.New("Failed to parse fill fees: " + err.Error())
 	}
 
-	return nil, f
+	return fill, nil
+}
+
+// Coinbase leaves out the amounts of an order that has not been filled at all
+func zeroIfEmpty(v string) string {
+	if v == "" {
+		return "0"
+	}
+	return v
 }
 
-func (c *Coinbase) SendEther(amount string, to eth.Address) error {
+func (c *Coinbase) SendEther(amount Wei, to eth.Address) (withdrawalId string, err error) {
 
-	log.Printf("Send %s ETH from Coinbase to %s", amount, to.Hex())
+	log.Printf("Send %s ETH from Coinbase to %s", amount.Ether(), to.Hex())
 
 	var params = CoinbaseWithdrawCryptoParams{
-		Amount:        amount,
+		Amount:        amount.Ether(),
 		Currency:      "ETH",
 		CryptoAddress: to.Hex(),
 	}
 	var result = CoinbaseWithdrawCryptoResult{}
 
-	_, err := c.client.Request(
+	res, err := c.client.Request(
 		"POST",
 		"/withdrawals/crypto",
 		params,
 		&result)
 
 	if err != nil {
-		return errors.New("Failed to transfer ETH from Coinbase to user: " + err.Error())
+		err = errors.New("Failed to transfer ETH from Coinbase to user: " + err.Error())
+
+		// Only a 4xx means Coinbase refused. After a timeout or 5xx the
+		// withdrawal may still have been made.
+		if res != nil && res.StatusCode >= 400 && res.StatusCode < 500 {
+			return "", SendRejectedError(err)
+		}
+		return "", err
 	}
 
-	return nil
+	log.Printf("Coinbase withdrawal %s sending %s ETH to %s", result.Id, amount.Ether(), to.Hex())
+	return result.Id, nil
 }
 
-func (c *Coinbase) GetEtherPrice() (float64, error) {
-	b, err := coinbaseClient.client.GetBook("ETH-EUR", 1)
+func (c *Coinbase) FindWithdrawal(amount Wei, to eth.Address, since time.Time) (withdrawalId string, err error) {
+	var transfers []CoinbaseTransfer
+
+	_, err = c.client.Request("GET", "/transfers?type=withdraw", nil, &transfers)
 	if err != nil {
-		return 0, err
+		return "", errors.New("Failed to get Coinbase withdrawals: " + err.Error())
 	}
-	f, err := strconv.ParseFloat(b.Asks[0].Price, 64)
+
+	for _, t := range transfers {
+		if !strings.EqualFold(t.Details.SentToAddress, to.Hex()) {
+			continue
+		}
+
+		a, err := ParseEther(t.Amount)
+		if err != nil || a.Cmp(amount) != 0 {
+			continue
+		}
+
+		created, err := ParseCoinbaseTime(t.CreatedAt)
+		if err != nil {
+			return "", errors.New("Failed to parse Coinbase withdrawal " + t.Id + ": " + err.Error())
+		}
+		if created.Before(since) {
+			continue
+		}
+
+		return t.Id, nil
+	}
+
+	return "", nil
+}
+
+func (c *Coinbase) GetWithdrawal(id string) (Withdrawal, error) {
+	var transfer CoinbaseTransfer
+
+	_, err := c.client.Request("GET", "/transfers/"+id, nil, &transfer)
+	if err != nil {
+		return Withdrawal{}, errors.New("Failed to get Coinbase withdrawal " + id + ": " + err.Error())
+	}
+
+	return WithdrawalFromTransfer(transfer)
+}
+
+func (c *Coinbase) GetEtherBalance() (Wei, error) {
+	var accounts []CoinbaseAccount
+
+	_, err := c.client.Request("GET", "/accounts", nil, &accounts)
+	if err != nil {
+		return Wei{}, errors.New("Failed to get Coinbase accounts: " + err.Error())
+	}
+
+	for _, a := range accounts {
+		if a.Currency == "ETH" {
+			return ParseEther(a.Available)
+		}
+	}
+
+	return Wei{}, errors.New("Coinbase has no ETH account")
+}
+
+func (c *Coinbase) GetEtherPrice(amountPence int) (float64, error) {
+	b, err := c.client.GetBook("ETH-GBP", 2)
+	if err != nil {
+		return 0, errors.New("Failed to get ETH-GBP order book: " + err.Error())
+	}
+
+	price, err := VolumeWeightedPrice(b.Asks, float64(amountPence)/100)
 	if err != nil {
 		return 0, err
 	}
-	return f, nil
+
+	return price * (1 + c.takerFeePercent/100), nil
+}
+
+func (c *Coinbase) GetMarket() (Market, error) {
+	b, err := c.client.GetBook("ETH-GBP", 2)
+	if err != nil {
+		return Market{}, errors.New("Failed to get ETH-GBP order book: " + err.Error())
+	}
+
+	if len(b.Bids) == 0 || len(b.Asks) == 0 {
+		return Market{}, errors.New("ETH-GBP order book is empty")
+	}
+
+	m := Market{}
+
+	m.Bid, err = strconv.ParseFloat(b.Bids[0].Price, 64)
+	if err != nil {
+		return Market{}, errors.New("Failed to parse bid price: " + err.Error())
+	}
+
+	depth := 0.0
+	for i, ask := range b.Asks {
+		price, err := strconv.ParseFloat(ask.Price, 64)
+		if err != nil {
+			return Market{}, errors.New("Failed to parse ask price: " + err.Error())
+		}
+		size, err := strconv.ParseFloat(ask.Size, 64)
+		if err != nil {
+			return Market{}, errors.New("Failed to parse ask size: " + err.Error())
+		}
+		if i == 0 {
+			m.Ask = price
+		}
+		depth += price * size
+	}
+	m.AskDepthPence = int(depth * 100)
+
+	return m, nil
+}
+
+// VolumeWeightedPrice returns the average price per Ether paid when spending
+// the given amount against the asks in an order book, cheapest first
+func VolumeWeightedPrice(asks []coinbase.BookEntry, amountGbp float64) (float64, error) {
+	if amountGbp <= 0 {
+		return 0, errors.New("Cannot price an amount of zero or less")
+	}
+
+	remaining := amountGbp
+	bought := 0.0
+
+	for _, ask := range asks {
+		price, err := strconv.ParseFloat(ask.Price, 64)
+		if err != nil {
+			return 0, errors.New("Failed to parse ask price: " + err.Error())
+		}
+		size, err := strconv.ParseFloat(ask.Size, 64)
+		if err != nil {
+			return 0, errors.New("Failed to parse ask size: " + err.Error())
+		}
+		if price <= 0 {
+			return 0, fmt.Errorf("Invalid ask price %f", price)
+		}
+
+		if price*size >= remaining {
+			bought += remaining / price
+			return amountGbp / bought, nil
+		}
+
+		bought += size
+		remaining -= price * size
+	}
+
+	return 0, fmt.Errorf("Order book is not deep enough to spend £%.2f", amountGbp)
 }
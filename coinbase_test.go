@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	coinbase "github.com/preichenberger/go-gdax"
+)
+
+func TestVolumeWeightedPrice(t *testing.T) {
+	asks := []coinbase.BookEntry{
+		{Price: "100", Size: "0.1"},
+		{Price: "110", Size: "0.5"},
+		{Price: "120", Size: "1"},
+	}
+
+	tests := []struct {
+		amountGbp float64
+		expected  float64
+	}{
+		// within the top of the book
+		{5, 100},
+		{10, 100},
+		// £10 at 100 and £55 at 110
+		{65, 65 / (0.1 + 0.5)},
+		// £10 at 100, £55 at 110 and £12 at 120
+		{77, 77 / (0.1 + 0.5 + 0.1)},
+	}
+
+	for _, test := range tests {
+		actual, err := VolumeWeightedPrice(asks, test.amountGbp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(actual-test.expected) > 1e-9 {
+			t.Errorf("price for £%f: %f, expected %f", test.amountGbp, actual, test.expected)
+		}
+	}
+
+	if _, err := VolumeWeightedPrice(asks, 1000); err == nil {
+		t.Error("priced more than the book can fill")
+	}
+
+	if _, err := VolumeWeightedPrice(asks, 0); err == nil {
+		t.Error("priced nothing")
+	}
+}
+
+func TestWaitForOrder(t *testing.T) {
+	statuses := []string{"pending", "open", "done"}
+	calls := 0
+	getOrder := func(id string) (coinbase.Order, error) {
+		status := statuses[calls]
+		calls++
+		if status == "open" {
+			return coinbase.Order{}, errors.New("network error")
+		}
+		return coinbase.Order{Id: id, Status: status, FilledSize: "0.5"}, nil
+	}
+
+	o, err := WaitForOrder(getOrder, "abc", time.Millisecond, time.Second)
+	if err != nil || o.FilledSize != "0.5" || calls != 3 {
+		t.Errorf("order %+v after %d calls: %v", o, calls, err)
+	}
+
+	stuck := func(id string) (coinbase.Order, error) {
+		return coinbase.Order{Id: id, Status: "open"}, nil
+	}
+
+	o, err = WaitForOrder(stuck, "abc", time.Millisecond, 10*time.Millisecond)
+	if !IsTransient(err) || o.Status != "open" {
+		t.Errorf("expected transient error, got %v", err)
+	}
+}
+
+func TestFillFromOrder(t *testing.T) {
+	fill, err := FillFromOrder(coinbase.Order{
+		Id:            "abc",
+		Status:        "done",
+		DoneReason:    "canceled",
+		FilledSize:    "0.25000000",
+		ExecutedValue: "25.0000000000000000",
+		FillFees:      "0.0625000000000000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fill.Done() || fill.Size.Ether() != "0.25" || fill.ValuePence != 2500 || fill.FeesPence != 7 || fill.CostPence() != 2507 {
+		t.Errorf("fill %+v", fill)
+	}
+
+	// Coinbase leaves out the amounts of an order that bought nothing
+	fill, err = FillFromOrder(coinbase.Order{Id: "abc", Status: "done", DoneReason: "canceled"})
+	if err != nil || fill.Size.Sign() != 0 || fill.CostPence() != 0 {
+		t.Errorf("fill %+v: %v", fill, err)
+	}
+}
+
+func TestWithdrawalFromTransfer(t *testing.T) {
+	hash := "0x5e0d3f9c1a0c8f4a0a2b1f7e3b6c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c"
+
+	tests := []struct {
+		transfer CoinbaseTransfer
+		status   string
+		txHash   string
+		fee      string
+	}{
+		{CoinbaseTransfer{Id: "a", CreatedAt: "2026-10-17 10:00:00.0+00"}, WithdrawalPending, "", "0"},
+		{CoinbaseTransfer{Id: "a", CreatedAt: "2026-10-17 10:00:00.0+00", CompletedAt: "2026-10-17 10:05:00.0+00",
+			Details: CoinbaseTransferDetails{CryptoTransactionHash: hash, Fee: "0.00042"}}, WithdrawalCompleted, hash, "0.00042"},
+		{CoinbaseTransfer{Id: "a", CreatedAt: "2026-10-17 10:00:00.0+00", CanceledAt: "2026-10-17 10:05:00.0+00"}, WithdrawalFailed, "", "0"},
+	}
+
+	for _, test := range tests {
+		w, err := WithdrawalFromTransfer(test.transfer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Id != "a" || w.Status != test.status || w.TxHash != test.txHash || w.Fee.Ether() != test.fee {
+			t.Errorf("withdrawal %+v, expected %s %s %s", w, test.status, test.txHash, test.fee)
+		}
+	}
+}
+
+func TestParseCoinbaseTime(t *testing.T) {
+	expected := time.Date(2019, 6, 18, 1, 37, 48, 789530000, time.UTC)
+
+	for _, s := range []string{"2019-06-18 01:37:48.78953+00", "2019-06-18T01:37:48.78953Z"} {
+		actual, err := ParseCoinbaseTime(s)
+		if err != nil || !actual.Equal(expected) {
+			t.Errorf("%s: %s, %v", s, actual, err)
+		}
+	}
+}
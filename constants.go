@@ -1,14 +1,116 @@
 package main
 
+import "time"
+
 const (
-	PortHttp           = 80                          //8081
-	PortHttps          = 443                         //8443
-	HttpsRedirectRoot  = "https://etherdirect.co.uk" // "https://localhost:8443"
-	HttpsCertificate   = "/etc/letsencrypt/live/etherdirect.co.uk/fullchain.pem"
-	HttpsPrivateKey    = "/etc/letsencrypt/live/etherdirect.co.uk/privkey.pem"
-	FileSystemRoot     = "./"
-	AddressEtherDirect = "0xDaEF995931D6F00F56226b29ba70353327b21E00"
-	ServiceChargeGBP   = 2
-	EtherValueGBP      = 10
-	OrderAmountPence   = (EtherValueGBP + ServiceChargeGBP) * 100
+	PortHttp            = 80                          //8081
+	PortHttps           = 443                         //8443
+	HttpsRedirectRoot   = "https://etherdirect.co.uk" // "https://localhost:8443"
+	HttpsCertificate    = "/etc/letsencrypt/live/etherdirect.co.uk/fullchain.pem"
+	HttpsPrivateKey     = "/etc/letsencrypt/live/etherdirect.co.uk/privkey.pem"
+	FileSystemRoot      = "./"
+	MonzoApiRoot        = "https://api.monzo.com/"
+	WebHookRecordingDir = FileSystemRoot + "webhooks/"
+	AddressEtherDirect  = "0xDaEF995931D6F00F56226b29ba70353327b21E00"
+	MinOrderPence       = 100
+	MaxOrderPence       = 5000
+
+	// Access codes are a unix time followed by a check digit. Codes issued
+	// before the check digit was added are still accepted.
+	AccessCodeLength       = 11
+	LegacyAccessCodeLength = 10
+	QueueWorkers           = 4
+	QueueMaxAttempts       = 8
+	QueueRetryBackoff      = 5 * time.Second
+	QueueMaxBackoff        = 10 * time.Minute
+
+	SettlementCheckInterval = time.Hour
+
+	// How much each customer can spend, unless overridden by DailyLimitGBP,
+	// WeeklyLimitGBP and MonthlyLimitGBP
+	DailyLimitGBP   = 100
+	WeeklyLimitGBP  = 250
+	MonthlyLimitGBP = 500
+
+	// Faster Payments references are at most 18 characters
+	RefundReferenceLength = 18
+
+	// Refunds over this amount wait for an operator to approve them, unless
+	// overridden by RefundReviewAbovePence
+	RefundReviewAboveGBP      = 25
+	FlaggedCounterpartiesFile = FileSystemRoot + "flagged-counterparties.txt"
+
+	// Orders whose Ether fails to send this many times are refunded or held,
+	// unless overridden by SendEtherMaxFailures
+	SendEtherMaxFailures = 5
+
+	// How long a quote is honoured for, unless overridden by QuoteValidityMinutes
+	QuoteValidity = 15 * time.Minute
+	QuoteDir      = FileSystemRoot + "quotes/"
+
+	// Each quote fetches a price from the exchange, so each client may ask for
+	// QuoteRateLimit quotes per QuoteRatePeriod, and everyone together for
+	// QuoteGlobalRateLimit
+	QuoteRateLimit       = 10
+	QuoteGlobalRateLimit = 120
+	QuoteRatePeriod      = time.Minute
+
+	// How often the Ether inventory is checked against Coinbase, and how far
+	// apart they may be before an incident is raised, unless overridden by
+	// InventoryToleranceEther
+	InventorySyncInterval   = 15 * time.Minute
+	InventoryToleranceEther = "0.001"
+
+	// How often the inventory is brought back within the band set by
+	// InventoryLowEther and InventoryHighEther
+	InventoryRebalanceInterval = 5 * time.Minute
+
+	// How much more Ether than we need to buy when inventory runs short, and
+	// the least Coinbase will sell, unless overridden by InventoryBufferEther
+	// and CoinbaseMinOrderEther
+	InventoryBufferEther  = "0.01"
+	CoinbaseMinOrderEther = "0.01"
+	CoinbaseSizeDecimals  = 8
+
+	// Coinbase's fee on market orders, unless overridden by CoinbaseTakerFeePercent
+	CoinbaseTakerFeePercent = 0.25
+
+	// How often to queue again unfinished orders that have been given up on
+	OrderSweepInterval = 10 * time.Minute
+
+	// How often to check on withdrawals to customers that have not finished
+	WithdrawalCheckInterval = 30 * time.Second
+
+	// How far Coinbase's clock may be behind ours when looking for a
+	// withdrawal that a failed request may have made
+	WithdrawalClockSkew = time.Minute
+
+	// How often to check whether a market order has finished, and how long to
+	// wait before trying again later
+	CoinbaseOrderPollInterval = 500 * time.Millisecond
+	CoinbaseOrderTimeout      = 30 * time.Second
+
+	// The fee schedule. DefaultFeeSchedule is used if it does not exist.
+	FeeScheduleFile = FileSystemRoot + "fees.json"
+
+	// Trading halts if a price is further than PriceMaxDeviationPercent from
+	// the median over PriceReferenceWindow, or PriceMaxSourceDeviationPercent
+	// from the secondary source, or if the book is wider than
+	// PriceMaxSpreadPercent or shallower than PriceMinDepthGBP. The halt is
+	// kept in HaltFile until an operator resets it, and the prices seen are
+	// kept in PriceHistoryFile so the reference survives a restart.
+	PriceMaxDeviationPercent       = 5.0
+	PriceReferenceWindow           = time.Hour
+	PriceMaxSourceDeviationPercent = 3.0
+	PriceMaxSpreadPercent          = 1.0
+	PriceMinDepthGBP               = 1000
+	HaltFile                       = FileSystemRoot + "halted.json"
+	PriceHistoryFile               = FileSystemRoot + "prices.json"
+
+	KrakenApiRoot = "https://api.kraken.com/"
+
+	// Trading is paused while MaintenanceFile exists. The server checks for
+	// it being removed from the command line every MaintenanceCheckInterval.
+	MaintenanceFile          = FileSystemRoot + "paused.json"
+	MaintenanceCheckInterval = 10 * time.Second
 )
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	eth "github.com/ethereum/go-ethereum/common"
+)
+
+// DryRunMonzo reads from a real Monzo account but only logs the changes it
+// would make
+type DryRunMonzo struct {
+	monzo IMonzo
+}
+
+func (d *DryRunMonzo) MoveToPot(potName string, amountPence int) error {
+	log.Printf("DRY RUN: would move %d into pot %s", amountPence, potName)
+	return nil
+}
+
+func (d *DryRunMonzo) GetTransaction(id string) (MonzoWebHookTransaction, error) {
+	return d.monzo.GetTransaction(id)
+}
+
+func (d *DryRunMonzo) PostInfo(heading string, msg string) error {
+	log.Printf("DRY RUN: would post %s: %s", heading, msg)
+	return nil
+}
+
+// DryRunCoinbase reads prices from the real exchange but only logs the trades
+// and withdrawals it would make
+type DryRunCoinbase struct {
+	coinbase ICoinbase
+}
+
+func (d *DryRunCoinbase) BuyEther(p EtherPurchase) (err error, fill Fill) {
+	// Sizes are priced at the top of the book, which is near enough for a dry run
+	funds := p.FundsPence
+	if p.Size.Sign() > 0 {
+		funds = MinOrderPence
+	}
+
+	price, err := d.coinbase.GetEtherPrice(funds)
+	if err != nil {
+		return err, Fill{}
+	}
+
+	fill = Fill{OrderId: "dry-run", Status: "done", DoneReason: "filled", Size: p.Size, ValuePence: p.FundsPence}
+	if p.Size.Sign() > 0 {
+		fill.ValuePence = PenceForEther(p.Size, price)
+	} else {
+		fill.Size, err = EtherForPence(p.FundsPence, price)
+		if err != nil {
+			return err, Fill{}
+		}
+	}
+
+	log.Printf("DRY RUN: would buy about %s ETH for %d", fill.Size.Ether(), fill.CostPence())
+	return nil, fill
+}
+
+func (d *DryRunCoinbase) GetFill(orderId string) (err error, fill Fill) {
+	return errors.New("DRY RUN: no order " + orderId), Fill{}
+}
+
+func (d *DryRunCoinbase) SellEther(size Wei) (err error, soldSize Wei, proceedsPence int) {
+	price, err := d.coinbase.GetEtherPrice(MinOrderPence)
+	if err != nil {
+		return err, Wei{}, 0
+	}
+
+	proceedsPence = PenceForEther(size, price)
+
+	log.Printf("DRY RUN: would sell %s ETH for about %d", size.Ether(), proceedsPence)
+	return nil, size, proceedsPence
+}
+
+func (d *DryRunCoinbase) SendEther(amount Wei, to eth.Address) (withdrawalId string, err error) {
+	log.Printf("DRY RUN: would send %s ETH to %s", amount.Ether(), to.Hex())
+	return "dry-run", nil
+}
+
+func (d *DryRunCoinbase) FindWithdrawal(amount Wei, to eth.Address, since time.Time) (withdrawalId string, err error) {
+	return "", nil
+}
+
+func (d *DryRunCoinbase) GetWithdrawal(id string) (Withdrawal, error) {
+	return Withdrawal{Id: id, Status: WithdrawalCompleted}, nil
+}
+
+func (d *DryRunCoinbase) GetEtherBalance() (Wei, error) {
+	return d.coinbase.GetEtherBalance()
+}
+
+func (d *DryRunCoinbase) GetEtherPrice(amountPence int) (float64, error) {
+	return d.coinbase.GetEtherPrice(amountPence)
+}
+
+func (d *DryRunCoinbase) GetMarket() (Market, error) {
+	return d.coinbase.GetMarket()
+}
+
+// DryRunBank only logs the refunds it would pay
+type DryRunBank struct{}
+
+func (d *DryRunBank) CreatePayee(name string, sortCode string, accountNumber string) (string, error) {
+	log.Printf("DRY RUN: would create payee %s %s %s", name, sortCode, accountNumber)
+	return "dry-run", nil
+}
+
+func (d *DryRunBank) Pay(payment BankPayment) (string, error) {
+	log.Printf("DRY RUN: would pay %d %s to %s with reference %s", payment.AmountPence, payment.Currency, payment.PayeeId, payment.Reference)
+	return "dry-run-" + payment.IdempotencyKey, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import "errors"
+
+type ErrorKind string
+
+const (
+	KindCustomer            ErrorKind = "customer"
+	KindCounterpartyMissing ErrorKind = "counterparty-missing"
+	KindLimitExceeded       ErrorKind = "limit-exceeded"
+	KindUpstreamTransient   ErrorKind = "upstream-transient"
+	KindUpstreamPermanent   ErrorKind = "upstream-permanent"
+	KindInternal            ErrorKind = "internal"
+	KindDeliveryFailed      ErrorKind = "delivery-failed"
+	KindHalted              ErrorKind = "halted"
+	KindPaused              ErrorKind = "paused"
+	KindSendRejected        ErrorKind = "send-rejected"
+	KindSendUncertain       ErrorKind = "send-uncertain"
+)
+
+// Reason codes tell the customer why their payment was refunded. They are the
+// refund's payment reference, so none may be longer than RefundReferenceLength.
+const (
+	ReasonInvalidAmount      = "INVALID_AMOUNT"
+	ReasonExcessAmount       = "EXCESS_AMOUNT"
+	ReasonWrongCurrency      = "WRONG_CURRENCY"
+	ReasonUnknownAccessCode  = "UNKNOWN_CODE"
+	ReasonAmbiguousReference = "AMBIGUOUS_CODE"
+	ReasonLimitExceeded      = "LIMIT_EXCEEDED"
+	ReasonOrderFailed        = "ORDER_FAILED"
+	ReasonDeliveryFailed     = "DELIVERY_FAILED"
+	ReasonQuoteExpired       = "QUOTE_EXPIRED"
+	ReasonQuoteMismatch      = "QUOTE_MISMATCH"
+	ReasonHalted             = "SERVICE_HALTED"
+)
+
+// OrderError says what kind of problem occurred so that ErrorPolicy can
+// decide what to do about it. Errors that are not OrderErrors are assumed to
+// be bugs.
+type OrderError struct {
+	Kind    ErrorKind
+	Reason  string
+	Message string
+}
+
+func (e *OrderError) Error() string {
+	return e.Message
+}
+
+// CustomerError is a mistake made by the customer, such as sending the wrong
+// amount. The reason code is passed on to the customer with their refund.
+func CustomerError(reason string, msg string) error {
+	return &OrderError{Kind: KindCustomer, Reason: reason, Message: msg}
+}
+
+func CounterpartyMissingError(msg string) error {
+	return &OrderError{Kind: KindCounterpartyMissing, Reason: ReasonOrderFailed, Message: msg}
+}
+
+func LimitExceededError(msg string) error {
+	return &OrderError{Kind: KindLimitExceeded, Reason: ReasonLimitExceeded, Message: msg}
+}
+
+// Transient wraps a failure of an upstream service that may succeed if retried
+func Transient(err error) error {
+	return &OrderError{Kind: KindUpstreamTransient, Reason: ReasonOrderFailed, Message: err.Error()}
+}
+
+// Permanent wraps a failure of an upstream service that will not go away by itself
+func Permanent(err error) error {
+	return &OrderError{Kind: KindUpstreamPermanent, Reason: ReasonOrderFailed, Message: err.Error()}
+}
+
+// DeliveryFailedError means we repeatedly failed to send the customer's Ether
+func DeliveryFailedError(msg string) error {
+	return &OrderError{Kind: KindDeliveryFailed, Reason: ReasonDeliveryFailed, Message: msg}
+}
+
+// HaltedError means we have stopped trading until an operator says otherwise
+func HaltedError(msg string) error {
+	return &OrderError{Kind: KindHalted, Reason: ReasonHalted, Message: msg}
+}
+
+// PausedError means an operator has paused trading
+func PausedError(msg string) error {
+	return &OrderError{Kind: KindPaused, Reason: ReasonHalted, Message: msg}
+}
+
+// SendRejectedError means the exchange refused to send Ether, so none was sent
+// and it is safe to try again
+func SendRejectedError(err error) error {
+	return &OrderError{Kind: KindSendRejected, Reason: ReasonDeliveryFailed, Message: err.Error()}
+}
+
+// SendUncertainError means we do not know whether Ether was sent, so the order
+// must not be sent again or refunded until an operator has checked
+func SendUncertainError(msg string) error {
+	return &OrderError{Kind: KindSendUncertain, Reason: ReasonDeliveryFailed, Message: msg}
+}
+
+// AsOrderError returns err as an OrderError, treating any other error as a bug
+func AsOrderError(err error) *OrderError {
+	var e *OrderError
+	if errors.As(err, &e) {
+		return e
+	}
+	return &OrderError{Kind: KindInternal, Reason: ReasonOrderFailed, Message: err.Error()}
+}
+
+func KindOf(err error) ErrorKind {
+	if err == nil {
+		return ""
+	}
+	return AsOrderError(err).Kind
+}
+
+func IsTransient(err error) bool {
+	return KindOf(err) == KindUpstreamTransient
+}
+
+type Action string
+
+const (
+	ActionNone   Action = "none"
+	ActionRefund Action = "refund"
+	ActionRetry  Action = "retry"
+	ActionHold   Action = "hold"
+	ActionPage   Action = "page"
+
+	// Leave the order where it is until trading resumes
+	ActionWait Action = "wait"
+)
+
+// ErrorPolicy decides what to do about each kind of error
+type ErrorPolicy struct {
+	// Hold payments that break a velocity limit for an operator to review
+	// instead of refunding them
+	HoldOverLimit bool
+
+	// Refund orders whose Ether could not be sent instead of holding them for
+	// an operator
+	RefundFailedDelivery bool
+
+	// Refund orders that arrive while trading is halted instead of keeping
+	// them until it resumes
+	RefundWhenHalted bool
+
+	// Refund orders that arrive while an operator has paused trading instead
+	// of keeping them until it is resumed
+	RefundWhenPaused bool
+}
+
+func (p *ErrorPolicy) Decide(err error) Action {
+	switch KindOf(err) {
+	case "":
+		return ActionNone
+	case KindCustomer:
+		return ActionRefund
+	case KindLimitExceeded:
+		if p.HoldOverLimit {
+			return ActionHold
+		}
+		return ActionRefund
+	case KindDeliveryFailed:
+		if p.RefundFailedDelivery {
+			return ActionRefund
+		}
+		return ActionHold
+	case KindHalted:
+		if p.RefundWhenHalted {
+			return ActionRefund
+		}
+		return ActionWait
+	case KindPaused:
+		if p.RefundWhenPaused {
+			return ActionRefund
+		}
+		return ActionWait
+	case KindCounterpartyMissing:
+		// We cannot refund without the customer's bank details
+		return ActionHold
+	case KindUpstreamTransient:
+		return ActionRetry
+	}
+	return ActionPage
+}
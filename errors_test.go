@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorPolicy(t *testing.T) {
+	policy := ErrorPolicy{}
+
+	tests := []struct {
+		err    error
+		action Action
+	}{
+		{nil, ActionNone},
+		{CustomerError(ReasonInvalidAmount, "Invalid amount"), ActionRefund},
+		{CounterpartyMissingError("Counterparty data missing"), ActionHold},
+		{LimitExceededError("Limit exceeded"), ActionRefund},
+		{Transient(errors.New("coinbase unavailable")), ActionRetry},
+		{Permanent(errors.New("insufficient funds")), ActionPage},
+		{errors.New("bug"), ActionPage},
+	}
+
+	for _, test := range tests {
+		if a := policy.Decide(test.err); a != test.action {
+			t.Errorf("%v: %s", test.err, a)
+		}
+	}
+
+	policy.HoldOverLimit = true
+	if a := policy.Decide(LimitExceededError("Limit exceeded")); a != ActionHold {
+		t.Errorf("over limit: %s", a)
+	}
+}
+
+func TestOrderErrorIsRecorded(t *testing.T) {
+	o := Order{}
+	o.SetError(CustomerError(ReasonWrongCurrency, "Wrong currency. Send GBP only"))
+
+	e := AsOrderError(o.Err())
+	if e.Kind != KindCustomer || e.Reason != ReasonWrongCurrency || e.Message != "Wrong currency. Send GBP only" {
+		t.Errorf("recorded error %v", e)
+	}
+
+	// Orders recorded before errors had kinds were always refunded
+	legacy := Order{Error: "Unknown access code"}
+	if KindOf(legacy.Err()) != KindCustomer {
+		t.Errorf("legacy error kind %s", KindOf(legacy.Err()))
+	}
+}
+
+func TestQueueHoldsOrdersWithoutCounterparty(t *testing.T) {
+	subject, monzo, _, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	order := newTestOrder("tx_anonymous")
+	order.SetError(CounterpartyMissingError("Counterparty data missing"))
+	monzo.SetTransaction(order.Transaction)
+
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(order.Id)
+	subject.Wait()
+
+	waitForState(t, subject.ledger, order.Id, OrderHeld)
+}
+
+func TestReasonCodesFitRefundReference(t *testing.T) {
+	codes := []string{
+		ReasonInvalidAmount, ReasonExcessAmount, ReasonWrongCurrency, ReasonUnknownAccessCode,
+		ReasonAmbiguousReference, ReasonLimitExceeded, ReasonOrderFailed, ReasonDeliveryFailed,
+		ReasonQuoteExpired, ReasonQuoteMismatch, ReasonHalted,
+	}
+	for _, code := range codes {
+		if len(code) > RefundReferenceLength {
+			t.Errorf("reason code %s is longer than %d", code, RefundReferenceLength)
+		}
+	}
+}
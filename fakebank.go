@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// FakeBankApi serves a bank payments API from memory, so refunds can be tested
+// without paying out real money. Point an HttpBank at it.
+type FakeBankApi struct {
+	Token    string
+	Payees   map[string]bankPayee
+	Payments map[string]BankPayment
+
+	// The number of payments to fail with a server error before succeeding
+	FailPayments int
+
+	mu sync.Mutex
+}
+
+func (f *FakeBankApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+f.Token {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/payees":
+		payee := bankPayee{}
+		if json.NewDecoder(r.Body).Decode(&payee) != nil || payee.SortCode == "" || payee.AccountNumber == "" {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if f.Payees == nil {
+			f.Payees = make(map[string]bankPayee)
+		}
+		id := fmt.Sprintf("payee_%d", len(f.Payees)+1)
+		f.Payees[id] = payee
+		json.NewEncoder(w).Encode(bankResult{Id: id})
+
+	case "/payments":
+		payment := BankPayment{}
+		if json.NewDecoder(r.Body).Decode(&payment) != nil || payment.AmountPence <= 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if _, ok := f.Payees[payment.PayeeId]; !ok {
+			http.Error(w, "Unknown payee", http.StatusBadRequest)
+			return
+		}
+		if f.FailPayments > 0 {
+			f.FailPayments--
+			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if f.Payments == nil {
+			f.Payments = make(map[string]BankPayment)
+		}
+		f.Payments[payment.IdempotencyKey] = payment
+		json.NewEncoder(w).Encode(bankResult{Id: "payment_" + payment.IdempotencyKey})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	eth "github.com/ethereum/go-ethereum/common"
+)
+
+// FakeCoinbase trades on an imaginary exchange at a fixed price
+type FakeCoinbase struct {
+	EtherPrice float64
+	BalanceEth Wei
+	Sent       map[string]Wei
+}
+
+func (c *FakeCoinbase) BuyEther(p EtherPurchase) (err error, fill Fill) {
+	fill = Fill{OrderId: "fake", Status: "done", DoneReason: "filled", Size: p.Size, ValuePence: p.FundsPence}
+	if p.Size.Sign() > 0 {
+		fill.ValuePence = PenceForEther(p.Size, c.EtherPrice)
+	} else {
+		fill.Size, err = EtherForPence(p.FundsPence, c.EtherPrice)
+		if err != nil {
+			return err, Fill{}
+		}
+	}
+	c.BalanceEth = c.BalanceEth.Add(fill.Size)
+
+	log.Printf("Fake Coinbase: bought %s ETH for %d", fill.Size.Ether(), fill.CostPence())
+	return nil, fill
+}
+
+// GetFill is never needed as every fake order is filled straight away
+func (c *FakeCoinbase) GetFill(orderId string) (err error, fill Fill) {
+	return errors.New("Fake Coinbase: no order " + orderId), Fill{}
+}
+
+func (c *FakeCoinbase) SellEther(size Wei) (err error, soldSize Wei, proceedsPence int) {
+	proceedsPence = PenceForEther(size, c.EtherPrice)
+	c.BalanceEth = c.BalanceEth.Sub(size)
+
+	log.Printf("Fake Coinbase: sold %s ETH for %d", size.Ether(), proceedsPence)
+	return nil, size, proceedsPence
+}
+
+func (c *FakeCoinbase) SendEther(amount Wei, to eth.Address) (withdrawalId string, err error) {
+	if c.Sent == nil {
+		c.Sent = make(map[string]Wei)
+	}
+	c.BalanceEth = c.BalanceEth.Sub(amount)
+	c.Sent[to.Hex()] = c.Sent[to.Hex()].Add(amount)
+
+	log.Printf("Fake Coinbase: sent %s ETH to %s", amount.Ether(), to.Hex())
+	return "fake", nil
+}
+
+func (c *FakeCoinbase) FindWithdrawal(amount Wei, to eth.Address, since time.Time) (withdrawalId string, err error) {
+	return "", nil
+}
+
+// GetWithdrawal reports every fake withdrawal as completed straight away
+func (c *FakeCoinbase) GetWithdrawal(id string) (Withdrawal, error) {
+	return Withdrawal{Id: id, Status: WithdrawalCompleted}, nil
+}
+
+func (c *FakeCoinbase) GetEtherPrice(amountPence int) (float64, error) {
+	return c.EtherPrice, nil
+}
+
+func (c *FakeCoinbase) GetEtherBalance() (Wei, error) {
+	return c.BalanceEth, nil
+}
+
+// GetMarket returns a tight, deep book around the fixed price
+func (c *FakeCoinbase) GetMarket() (Market, error) {
+	return Market{Bid: c.EtherPrice, Ask: c.EtherPrice, AskDepthPence: MaxOrderPence * 1000}, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// FakeMonzoApi serves the parts of the Monzo API that we use from memory, so
+// the server can be run and tested without a real bank account. Point a Monzo
+// client's BaseURL at it.
+type FakeMonzoApi struct {
+	AccessToken  string
+	Transactions map[string]MonzoWebHookTransaction
+	mu           sync.Mutex
+}
+
+func (f *FakeMonzoApi) AddTransaction(tx MonzoWebHookTransaction) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Transactions == nil {
+		f.Transactions = make(map[string]MonzoWebHookTransaction)
+	}
+	f.Transactions[tx.Id] = tx
+}
+
+func (f *FakeMonzoApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+f.AccessToken {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/transactions/"):
+		f.getTransaction(w, r, strings.TrimPrefix(r.URL.Path, "/transactions/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *FakeMonzoApi) getTransaction(w http.ResponseWriter, r *http.Request, id string) {
+	f.mu.Lock()
+	tx, ok := f.Transactions[id]
+	f.mu.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Transaction MonzoWebHookTransaction `json:"transaction"`
+	}{tx})
+}
+
+// FakeMonzo is an in-memory stand in for our Monzo account
+type FakeMonzo struct {
+	Pots         map[string]int
+	Transactions map[string]MonzoWebHookTransaction
+	mu           sync.Mutex
+}
+
+func (f *FakeMonzo) SetTransaction(tx MonzoWebHookTransaction) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Transactions == nil {
+		f.Transactions = make(map[string]MonzoWebHookTransaction)
+	}
+	f.Transactions[tx.Id] = tx
+}
+
+func (f *FakeMonzo) MoveToPot(potName string, amountPence int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Pots == nil {
+		f.Pots = make(map[string]int)
+	}
+	f.Pots[potName] += amountPence
+
+	log.Printf("Fake Monzo: moved %d into pot %s", amountPence, potName)
+	return nil
+}
+
+func (f *FakeMonzo) GetTransaction(id string) (MonzoWebHookTransaction, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tx, ok := f.Transactions[id]
+	if !ok {
+		return tx, errors.New("Monzo transaction " + id + " does not exist")
+	}
+	return tx, nil
+}
+
+func (f *FakeMonzo) PostInfo(heading string, msg string) error {
+	log.Printf("Fake Monzo: posted %s: %s", heading, msg)
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+// FeeTier is the fee charged on payments up to a given amount
+type FeeTier struct {
+	// The largest payment the tier applies to. Zero means no limit.
+	UpToPence int
+
+	Percent    float64
+	FixedPence int
+
+	// Limits on the percentage plus fixed fee. Zero means no limit.
+	MinPence int
+	MaxPence int
+}
+
+// FeeSchedule decides how much of a payment we keep. The first tier that
+// covers the payment sets the fee, then the rest of the payment buys Ether at
+// SpreadPercent over the mid price of the book.
+type FeeSchedule struct {
+	Tiers         []FeeTier
+	SpreadPercent float64
+}
+
+// FeeBreakdown shows how the commission on an order was made up
+type FeeBreakdown struct {
+	Tier         int
+	PercentPence int
+	FixedPence   int
+
+	// How much the fee was raised or lowered to fit the tier's limits
+	AdjustmentPence int
+
+	SpreadPence int
+
+	// The total is taken as commission, the rest of the payment buys Ether at
+	// the price we pay on the exchange
+	TotalPence int
+}
+
+// DefaultFeeSchedule is used if no fee schedule is configured
+var DefaultFeeSchedule = FeeSchedule{
+	Tiers: []FeeTier{{Percent: 15}},
+}
+
+// LoadFeeSchedule reads a fee schedule from a JSON file, or returns the
+// default schedule if the file does not exist
+func LoadFeeSchedule(filename string) (FeeSchedule, error) {
+	dat, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return DefaultFeeSchedule, nil
+	}
+	if err != nil {
+		return FeeSchedule{}, err
+	}
+
+	s := FeeSchedule{}
+	err = json.Unmarshal(dat, &s)
+	if err != nil {
+		return s, errors.New("Failed to parse fee schedule: " + err.Error())
+	}
+
+	return s, s.Validate()
+}
+
+func (s *FeeSchedule) Validate() error {
+	if len(s.Tiers) == 0 {
+		return errors.New("Fee schedule has no tiers")
+	}
+	if s.SpreadPercent < 0 {
+		return errors.New("Fee schedule spread is negative")
+	}
+
+	for i, t := range s.Tiers {
+		last := i == len(s.Tiers)-1
+		switch {
+		case t.UpToPence == 0 && !last:
+			return fmt.Errorf("Fee tier %d has no limit but is not the last tier", i)
+		case i > 0 && t.UpToPence != 0 && t.UpToPence <= s.Tiers[i-1].UpToPence:
+			return fmt.Errorf("Fee tier %d is not larger than the tier before it", i)
+		case t.Percent < 0 || t.Percent >= 100 || t.FixedPence < 0:
+			return fmt.Errorf("Fee tier %d has an invalid fee", i)
+		case t.MinPence < 0 || t.MaxPence < 0 || (t.MaxPence != 0 && t.MaxPence < t.MinPence):
+			return fmt.Errorf("Fee tier %d has invalid limits", i)
+		}
+	}
+
+	return nil
+}
+
+// Calculate works out the tier's fee on a payment, leaving the spread to
+// AddSpread once the price is known. Every part is rounded down. It is a
+// CustomerError if the fee would take the whole payment.
+func (s *FeeSchedule) Calculate(amountPence int) (FeeBreakdown, error) {
+	b := FeeBreakdown{Tier: -1}
+	for i, t := range s.Tiers {
+		if t.UpToPence == 0 || amountPence <= t.UpToPence {
+			b.Tier = i
+			break
+		}
+	}
+	if b.Tier < 0 {
+		return b, fmt.Errorf("No fee tier covers a payment of %d", amountPence)
+	}
+
+	t := s.Tiers[b.Tier]
+	b.PercentPence = int(float64(amountPence) * t.Percent / 100)
+	b.FixedPence = t.FixedPence
+
+	fee := b.PercentPence + b.FixedPence
+	if fee < t.MinPence {
+		fee = t.MinPence
+	}
+	if t.MaxPence != 0 && fee > t.MaxPence {
+		fee = t.MaxPence
+	}
+	if fee >= amountPence {
+		return b, CustomerError(ReasonInvalidAmount, fmt.Sprintf("Amount too small for fee. Send more than £%.2f", float64(fee)/100))
+	}
+	b.AdjustmentPence = fee - b.PercentPence - b.FixedPence
+
+	b.TotalPence = fee
+	return b, nil
+}
+
+// AddSpread adds the spread to the fees on a payment of amountPence, given the
+// price we pay on the exchange, including its taker fee, and the mid price of
+// the book. The customer buys at SpreadPercent over the mid price, or at our
+// price if that is higher, which is the same as buying less at our price. The
+// spread is rounded down.
+func (s *FeeSchedule) AddSpread(b *FeeBreakdown, amountPence int, price float64, mid float64) {
+	customerPrice := mid * (1 + s.SpreadPercent/100)
+	if customerPrice < price {
+		customerPrice = price
+	}
+
+	rest := amountPence - b.TotalPence
+	b.SpreadPence = rest - int(math.Ceil(float64(rest)*price/customerPrice))
+	b.TotalPence += b.SpreadPence
+}
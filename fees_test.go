@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+func TestFeeSchedule(t *testing.T) {
+	subject := FeeSchedule{
+		Tiers: []FeeTier{
+			{UpToPence: 1000, Percent: 10, FixedPence: 20, MinPence: 50},
+			{UpToPence: 3000, Percent: 5, FixedPence: 20, MaxPence: 120},
+			{Percent: 2},
+		},
+		SpreadPercent: 1,
+	}
+
+	if err := subject.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		amount   int
+		expected FeeBreakdown
+	}{
+		// the minimum fee is charged on small payments
+		{200, FeeBreakdown{Tier: 0, PercentPence: 20, FixedPence: 20, AdjustmentPence: 10, TotalPence: 50}},
+		{1000, FeeBreakdown{Tier: 0, PercentPence: 100, FixedPence: 20, TotalPence: 120}},
+		{2000, FeeBreakdown{Tier: 1, PercentPence: 100, FixedPence: 20, TotalPence: 120}},
+		// the maximum fee is charged on larger payments
+		{3000, FeeBreakdown{Tier: 1, PercentPence: 150, FixedPence: 20, AdjustmentPence: -50, TotalPence: 120}},
+		{5000, FeeBreakdown{Tier: 2, PercentPence: 100, TotalPence: 100}},
+	}
+
+	for _, test := range tests {
+		actual, err := subject.Calculate(test.amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != test.expected {
+			t.Errorf("fees on %d: %+v, expected %+v", test.amount, actual, test.expected)
+		}
+	}
+
+	// a fee that would take the whole payment is refunded rather than retried
+	small := FeeSchedule{Tiers: []FeeTier{{FixedPence: 100}}}
+	for _, amount := range []int{50, 100} {
+		if _, err := small.Calculate(amount); KindOf(err) != KindCustomer {
+			t.Errorf("fee on %d: %v", amount, err)
+		}
+	}
+	if _, err := small.Calculate(101); err != nil {
+		t.Error(err)
+	}
+
+	actual, _ := DefaultFeeSchedule.Calculate(1000)
+	if actual.TotalPence != 150 {
+		t.Errorf("default fees %+v", actual)
+	}
+
+	invalid := []FeeSchedule{
+		{},
+		{Tiers: []FeeTier{{Percent: 100}}},
+		{Tiers: []FeeTier{{Percent: 5}, {UpToPence: 1000}}},
+		{Tiers: []FeeTier{{UpToPence: 1000}, {UpToPence: 500}}},
+		{Tiers: []FeeTier{{MinPence: 100, MaxPence: 50}}},
+		{Tiers: []FeeTier{{Percent: 5}}, SpreadPercent: -1},
+	}
+	for i, s := range invalid {
+		if s.Validate() == nil {
+			t.Errorf("invalid schedule %d accepted", i)
+		}
+	}
+}
+
+func TestFeeScheduleAddSpread(t *testing.T) {
+	subject := FeeSchedule{Tiers: []FeeTier{{Percent: 10}}, SpreadPercent: 1}
+
+	tests := []struct {
+		price    float64
+		expected int
+	}{
+		// the exchange's taker fee comes out of the spread over the mid price
+		{100, 9},
+		{100.5, 4},
+		// never less than we pay
+		{102, 0},
+	}
+
+	for _, test := range tests {
+		b, err := subject.Calculate(1100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject.AddSpread(&b, 1100, test.price, 100)
+		if b.SpreadPence != test.expected || b.TotalPence != 110+test.expected {
+			t.Errorf("spread at %f: %+v, expected %d", test.price, b, test.expected)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"strings"
 
 	eth "github.com/ethereum/go-ethereum/common"
 )
@@ -18,21 +19,73 @@ func HandleError(err error) {
 		return
 	}
 
+	// Problems that only an operator can fix are raised as incidents
+	if errorPolicy.Decide(err) == ActionPage {
+		RaiseIncident(err)
+		return
+	}
+
 	log.Println(err.Error())
 
-	err = monzoClient.PostError(err)
+	// Posted through the order logic's Monzo so replays never reach the live feed
+	err = logic.monzo.PostInfo("ERROR", err.Error())
 
 	if err != nil {
 		log.Println("Failed to post to Monzo feed: " + err.Error())
 	}
 }
 
+// RaiseIncident reports a problem that an operator must deal with straight away
+func RaiseIncident(err error) {
+	log.Println("INCIDENT: " + err.Error())
+
+	err = logic.monzo.PostInfo("INCIDENT", err.Error())
+
+	if err != nil {
+		log.Println("Failed to post to Monzo feed: " + err.Error())
+	}
+}
+
+// WriteJSONFile saves v to a temporary file first and then renames it into
+// place, so a crash never leaves a half written file
+func WriteJSONFile(filename string, v interface{}) error {
+	dat, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	err = ioutil.WriteFile(tmp, dat, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
 func IsValidAddress(v string) bool {
 	re := regexp.MustCompile("^0x[0-9a-fA-F]{40}$")
 	return re.MatchString(v)
 }
 
+func IsValidTransactionId(v string) bool {
+	re := regexp.MustCompile("^tx_[0-9a-zA-Z]+$")
+	return re.MatchString(v)
+}
+
+// IsValidAccessCode checks the code is the right shape to be an access code,
+// so that it is safe to use as a filename
+func IsValidAccessCode(v string) bool {
+	if len(v) != AccessCodeLength && len(v) != LegacyAccessCodeLength {
+		return false
+	}
+	re := regexp.MustCompile("^[0-9]+$")
+	return re.MatchString(v)
+}
+
 func AccessCodeToEthereumAddress(accessCode string) (string, error) {
+	if !IsValidAccessCode(accessCode) {
+		return "", errors.New("Invalid access code: " + accessCode)
+	}
 	dat, err := ioutil.ReadFile(fmt.Sprintf("%saccess-codes/%s.txt", FileSystemRoot, accessCode))
 	if err != nil {
 		return "", err
@@ -40,25 +93,37 @@ func AccessCodeToEthereumAddress(accessCode string) (string, error) {
 	return string(dat), nil
 }
 
-func ParseOrder(r *http.Request) (err error, tx Order) {
-	var data = MonzoWebHook{}
-
+func DecodeWebHook(r *http.Request) (data MonzoWebHook, err error) {
 	decoder := json.NewDecoder(r.Body)
 	err = decoder.Decode(&data)
 	if err != nil {
-		return errors.New("Failed to parse request body: " + err.Error()), tx
+		return data, errors.New("Failed to parse request body: " + err.Error())
 	}
 
 	log.Println(data)
 
-	if data.Type != "transaction.created" {
-		return errors.New("Unexpected WebHook type: " + data.Type), tx
+	return data, nil
+}
+
+func ParseOrder(data MonzoWebHook) (err error, tx Order) {
+
+	tx.Transaction = data.Data
+
+	if data.Type != "transaction.created" && data.Type != "transaction.updated" {
+		return Permanent(errors.New("Unexpected WebHook type: " + data.Type)), tx
 	}
 
 	if data.Data.AccountId != os.Getenv("MonzoAccountId") {
-		return errors.New("Incorrect account ID"), tx
+		return Permanent(errors.New("Incorrect account ID")), tx
 	}
 
+	// The transaction ID is also the order ID, so only accept IDs that are safe to use as a filename
+	if !IsValidTransactionId(data.Data.Id) {
+		return Permanent(errors.New("Invalid transaction ID: " + data.Data.Id)), tx
+	}
+
+	tx.Id = data.Data.Id
+
 	tx.SortCode = data.Data.CounterParty.SortCode
 	tx.AccountNumber = data.Data.CounterParty.AccountNumber
 	tx.Amount = data.Data.Amount
@@ -69,91 +134,137 @@ func ParseOrder(r *http.Request) (err error, tx Order) {
 	}
 
 	if tx.SortCode == "" || tx.AccountNumber == "" {
-		return errors.New("Counterparty data missing"), tx
+		return CounterpartyMissingError("Counterparty data missing"), tx
 	}
 
-	if tx.Amount < 100 || tx.Amount > 5000 {
-		return errors.New("Invalid amount. Send £1 - £50"), tx
+	// Payments over the maximum may be fulfilled up to the maximum, with the excess refunded
+	if tx.Amount < MinOrderPence || (tx.Amount > MaxOrderPence && os.Getenv("PartialFulfilment") != "true") {
+		return CustomerError(ReasonInvalidAmount, fmt.Sprintf("Invalid amount. Send £%d - £%d", MinOrderPence/100, MaxOrderPence/100)), tx
 	}
 
 	if data.Data.Currency != "GBP" {
-		return errors.New("Wrong currency. Send GBP only"), tx
+		return CustomerError(ReasonWrongCurrency, "Wrong currency. Send GBP only"), tx
+	}
+
+	// Remember which access codes were found so that a quote can be matched
+	codes := make(map[eth.Address]string)
+	lookup := func(accessCode string) (string, error) {
+		a, err := AccessCodeToEthereumAddress(accessCode)
+		if err == nil {
+			codes[eth.HexToAddress(strings.TrimSpace(a))] = accessCode
+		}
+		return a, err
 	}
 
-	ethereumAddress, err := AccessCodeToEthereumAddress(data.Data.Description)
+	ethereumAddress, notes, err := ParseReference(data.Data.Description, lookup)
+	tx.ReferenceNotes = notes
+	for _, n := range notes {
+		log.Printf("Transaction %s: %s", tx.Id, n)
+	}
 	if err != nil {
-		return errors.New("Unknown access code"), tx
+		return err, tx
 	}
 
-	tx.EthAddress = eth.HexToAddress(ethereumAddress)
+	tx.EthAddress = ethereumAddress
+	tx.AccessCode = codes[ethereumAddress]
 
 	return nil, tx
 }
 
-func Refund(tx Order, err error) error {
+// VerifyOrder fetches the order's transaction from the Monzo API and checks it
+// matches the webhook, so that a forged webhook can never trigger a payment.
+// Returns the transaction as Monzo currently sees it.
+func VerifyOrder(o *Order, m IMonzo) (actual MonzoWebHookTransaction, err error) {
+	sent := o.Transaction
 
-	if tx.SortCode == "" || tx.AccountNumber == "" || tx.Currency == "" {
-		return errors.New("An error occurred but we do not have enough information to issue a refund: " + err.Error())
+	if !IsValidTransactionId(sent.Id) {
+		return actual, Permanent(errors.New("Cannot verify a transaction without a valid ID"))
 	}
 
-	monzoClient.PostInfo("REFUND", fmt.Sprintf("%s %s %d %s %s", tx.SortCode, tx.AccountNumber, tx.Amount, tx.Currency, err.Error()))
+	actual, err = m.GetTransaction(sent.Id)
+	if err != nil {
+		return actual, err
+	}
 
-	err2 := monzoClient.MoveToPot("refund", tx.Amount)
+	var mismatches []string
+	if actual.AccountId != sent.AccountId {
+		mismatches = append(mismatches, "account")
+	}
+	if actual.Amount != sent.Amount {
+		mismatches = append(mismatches, "amount")
+	}
+	if actual.Currency != sent.Currency {
+		mismatches = append(mismatches, "currency")
+	}
+	if actual.CounterParty != sent.CounterParty {
+		mismatches = append(mismatches, "counterparty")
+	}
+	if actual.Description != sent.Description {
+		mismatches = append(mismatches, "description")
+	}
 
-	if err2 != nil {
-		return errors.New("Failed to deposit into Refund pot: " + err2.Error() + ". Original error: " + err.Error())
+	if len(mismatches) > 0 {
+		return actual, Permanent(errors.New("Webhook does not match Monzo transaction " + sent.Id + ": " + strings.Join(mismatches, ", ")))
 	}
 
-	return err
+	return actual, nil
 }
 
-func ProcessOrder(w http.ResponseWriter, r *http.Request) error {
+// ProcessOrder records an incoming bank transfer in the ledger and queues it to
+// be verified with Monzo and then fulfilled or refunded. The webhook is
+// acknowledged as soon as the order is safely on disk.
+func ProcessOrder(q *Queue, w http.ResponseWriter, r *http.Request) error {
 
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return errors.New("Invalid request method: " + r.Method)
 	}
 
-	// TODO verify that this is really from Monzo
+	data, err := DecodeWebHook(r)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return err
+	}
+
+	if data.Type == "transaction.updated" {
+		err = q.Update(data.Data)
+		if err != ErrUnknownOrder {
+			if IsTransient(err) {
+				// Let Monzo retry the webhook later
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+			}
+			return err
+		}
+		// We never heard about this transaction being created, so treat it as a new order
+	}
 
 	// Parse and validate the incoming bank transfer
-	err, order := ParseOrder(r)
+	err, order := ParseOrder(data)
 	log.Println(order)
-	if err != nil {
-		// If it's invalid refund the user
-		return Refund(order, err)
-	}
 
 	// Ignore outgoing transaction
-	if order.Amount <= 0 {
+	if err == nil && order.Amount <= 0 {
 		return nil
 	}
 
-	return logic.Fulfill(order)
-
-	// // Try to buy ether
-	// err, amount := coinbaseClient.BuyEther()
-	// if err != nil {
-	// 	// If buying ether fails, refund the user
-	// 	return Refund(order, err)
-	// }
-
-	// // Try to send Ether to user
-	// err = coinbaseClient.SendEther(amount, order.EthAddress)
-	// if err != nil {
-	// 	// If sending ether to user fails, refund
-	// 	return Refund(order, err)
-	// 	// TODO try to sell the ether on coinbase?
-	// }
-
-	// // Interaction with user is complete, now try to balance our internal books
+	// If it's invalid the queue will refund the user, or whatever the error policy says
+	if err != nil {
+		order.SetError(err)
+	}
 
-	// err = monzoClient.MoveToPot("coinbase", EtherValueGBP*100)
-	// if err != nil {
-	// 	return err
-	// }
+	err2 := q.ledger.Receive(&order)
+	if err2 == ErrDuplicateOrder {
+		// Monzo retries webhooks it thinks have failed, we have already dealt with this one
+		log.Printf("Ignoring duplicate webhook for transaction %s", order.Id)
+		return nil
+	}
+	if err2 != nil {
+		// Let Monzo retry the webhook later
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return errors.New("Failed to record order: " + err2.Error())
+	}
 
-	// err = monzoClient.MoveToPot("profit", ServiceChargeGBP*100)
+	q.Push(order.Id)
 
-	// return err
+	return nil
 }
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Market is the state of the ETH-GBP order book when an order is priced
+type Market struct {
+	Bid float64
+	Ask float64
+
+	// The value of the asks on the book
+	AskDepthPence int
+}
+
+// Mid is the price halfway between the best bid and ask
+func (m Market) Mid() float64 {
+	return (m.Bid + m.Ask) / 2
+}
+
+// SpreadPercent is the gap between the best bid and ask as a percentage of the
+// mid price
+func (m Market) SpreadPercent() float64 {
+	mid := m.Mid()
+	if mid <= 0 {
+		return math.Inf(1)
+	}
+	return (m.Ask - m.Bid) / mid * 100
+}
+
+// IPriceSource is a second opinion on the price of Ether in GBP
+type IPriceSource interface {
+	GetEtherPrice() (float64, error)
+}
+
+// Halt records why trading was stopped
+type Halt struct {
+	Reason string
+	Price  float64
+	Time   time.Time
+}
+
+// PriceGuard stops trading if a price looks wrong, in case the exchange is
+// returning a stale or manipulated book. Once tripped it stays halted, even
+// across restarts, until an operator resets it.
+type PriceGuard struct {
+	// How far a price may stray from the median of the prices seen in Window
+	MaxDeviationPercent float64
+	Window              time.Duration
+
+	// The widest spread and the shallowest book we will trade on
+	MaxSpreadPercent float64
+	MinDepthPence    int
+
+	// How far a price may stray from the secondary source, if there is one
+	MaxSourceDeviationPercent float64
+	secondary                 IPriceSource
+
+	// Where the halt and the prices seen are kept. Empty means they are only
+	// kept in memory.
+	file        string
+	historyFile string
+
+	mu      sync.Mutex
+	history []PricePoint
+	halt    *Halt
+}
+
+// PricePoint is a price that passed the checks
+type PricePoint struct {
+	Price float64
+	Time  time.Time
+}
+
+// Init loads the halt and the prices seen by a previous run, if any
+func (g *PriceGuard) Init() error {
+	h := &Halt{}
+	found, err := readJSONFile(g.file, h)
+	if err != nil {
+		return err
+	}
+	if found {
+		log.Printf("Trading halted since %s: %s", h.Time.Format(time.RFC3339), h.Reason)
+		g.halt = h
+	}
+
+	_, err = readJSONFile(g.historyFile, &g.history)
+	return err
+}
+
+// readJSONFile reads v from the file, if there is one
+func readJSONFile(filename string, v interface{}) (found bool, err error) {
+	if filename == "" {
+		return false, nil
+	}
+
+	dat, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = json.Unmarshal(dat, v)
+	if err != nil {
+		return false, errors.New("Failed to parse " + filename + ": " + err.Error())
+	}
+	return true, nil
+}
+
+// Halted returns why trading was stopped, or nil if it was not
+func (g *PriceGuard) Halted() *Halt {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.halt
+}
+
+// Reference is the median of the prices seen in the window, or zero if there
+// are none
+func (g *PriceGuard) Reference(now time.Time) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.reference(now)
+}
+
+// Check returns a HaltedError if trading is halted or the price looks wrong,
+// in which case trading is halted until Reset is called
+func (g *PriceGuard) Check(price float64, market Market, now time.Time) error {
+
+	// Ask the secondary source before taking the lock, it may be slow
+	secondary := 0.0
+	if g.secondary != nil && g.Halted() == nil {
+		var err error
+		secondary, err = g.secondary.GetEtherPrice()
+		if err != nil {
+			return Transient(errors.New("Failed to get price from secondary source: " + err.Error()))
+		}
+	}
+
+	g.mu.Lock()
+
+	if g.halt != nil {
+		g.mu.Unlock()
+		return HaltedError("Trading halted: " + g.halt.Reason)
+	}
+
+	reason := ""
+	if spread := market.SpreadPercent(); spread > g.MaxSpreadPercent {
+		reason = fmt.Sprintf("spread of %.2f%% between %f and %f is over %.2f%%", spread, market.Bid, market.Ask, g.MaxSpreadPercent)
+	} else if market.AskDepthPence < g.MinDepthPence {
+		reason = fmt.Sprintf("only %d of asks on the book, need %d", market.AskDepthPence, g.MinDepthPence)
+	} else if ref := g.reference(now); ref > 0 && deviationPercent(price, ref) > g.MaxDeviationPercent {
+		reason = fmt.Sprintf("price %f is %.2f%% from the reference %f", price, deviationPercent(price, ref), ref)
+	} else if secondary > 0 && deviationPercent(price, secondary) > g.MaxSourceDeviationPercent {
+		reason = fmt.Sprintf("price %f is %.2f%% from the secondary source's %f", price, deviationPercent(price, secondary), secondary)
+	}
+
+	if reason == "" {
+		g.history = append(g.history, PricePoint{Price: price, Time: now})
+		err := g.saveHistory()
+		g.mu.Unlock()
+
+		if err != nil {
+			log.Println("Failed to save price history: " + err.Error())
+		}
+		return nil
+	}
+
+	g.halt = &Halt{Reason: reason, Price: price, Time: now}
+	err := g.save()
+	g.mu.Unlock()
+
+	if err != nil {
+		log.Println("Failed to save halt: " + err.Error())
+	}
+
+	RaiseIncident(errors.New("Trading halted: " + reason))
+	return HaltedError("Trading halted: " + reason)
+}
+
+// Reset lets trading resume. The prices seen before the halt are forgotten, and
+// the secondary source's price becomes the reference if there is one. Otherwise
+// the next price does.
+func (g *PriceGuard) Reset(operator string) error {
+
+	// Ask the secondary source before taking the lock, it may be slow
+	var seed []PricePoint
+	if g.secondary != nil {
+		price, err := g.secondary.GetEtherPrice()
+		if err != nil {
+			return errors.New("Failed to get price from secondary source: " + err.Error())
+		}
+		seed = []PricePoint{{Price: price, Time: time.Now()}}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.halt == nil {
+		return nil
+	}
+
+	if g.file != "" {
+		err := os.Remove(g.file)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.New("Failed to remove " + g.file + ": " + err.Error())
+		}
+	}
+
+	log.Printf("Operator %s resumed trading, halted since %s: %s", operator, g.halt.Time.Format(time.RFC3339), g.halt.Reason)
+
+	g.halt = nil
+	g.history = seed
+	return g.saveHistory()
+}
+
+func (g *PriceGuard) reference(now time.Time) float64 {
+
+	// Forget prices that have left the window
+	i := 0
+	for i < len(g.history) && now.Sub(g.history[i].Time) > g.Window {
+		i++
+	}
+	g.history = g.history[i:]
+
+	if len(g.history) == 0 {
+		return 0
+	}
+
+	prices := make([]float64, len(g.history))
+	for i, p := range g.history {
+		prices[i] = p.Price
+	}
+	sort.Float64s(prices)
+
+	n := len(prices)
+	if n%2 == 1 {
+		return prices[n/2]
+	}
+	return (prices[n/2-1] + prices[n/2]) / 2
+}
+
+func (g *PriceGuard) save() error {
+	if g.file == "" {
+		return nil
+	}
+
+	return WriteJSONFile(g.file, g.halt)
+}
+
+func (g *PriceGuard) saveHistory() error {
+	if g.historyFile == "" {
+		return nil
+	}
+
+	return WriteJSONFile(g.historyFile, g.history)
+}
+
+func deviationPercent(price float64, reference float64) float64 {
+	return math.Abs(price-reference) / reference * 100
+}
+
+// KrakenPriceSource reads the last traded price of Ether in GBP from Kraken
+type KrakenPriceSource struct {
+	root string
+}
+
+type krakenTicker struct {
+	Error  []string `json:"error"`
+	Result map[string]struct {
+		// The last trade's price and volume
+		C []string `json:"c"`
+	} `json:"result"`
+}
+
+func (k *KrakenPriceSource) GetEtherPrice() (float64, error) {
+	resp, err := http.Get(k.root + "0/public/Ticker?pair=ETHGBP")
+	if err != nil {
+		return 0, errors.New("Failed to get Kraken ticker: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Failed to get Kraken ticker: %s", resp.Status)
+	}
+
+	ticker := krakenTicker{}
+	err = json.NewDecoder(resp.Body).Decode(&ticker)
+	if err != nil {
+		return 0, errors.New("Failed to parse Kraken ticker: " + err.Error())
+	}
+	if len(ticker.Error) > 0 {
+		return 0, fmt.Errorf("Failed to get Kraken ticker: %v", ticker.Error)
+	}
+
+	for _, pair := range ticker.Result {
+		if len(pair.C) == 0 {
+			break
+		}
+		return strconv.ParseFloat(pair.C[0], 64)
+	}
+
+	return 0, errors.New("Kraken ticker has no ETHGBP price")
+}
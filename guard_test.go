@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+type MockPriceSource struct {
+	Price float64
+	Err   error
+}
+
+func (s *MockPriceSource) GetEtherPrice() (float64, error) {
+	return s.Price, s.Err
+}
+
+func newTestGuard() *PriceGuard {
+	return &PriceGuard{
+		MaxDeviationPercent:       5,
+		Window:                    time.Hour,
+		MaxSpreadPercent:          1,
+		MinDepthPence:             100000,
+		MaxSourceDeviationPercent: 3,
+	}
+}
+
+func TestPriceGuardTrips(t *testing.T) {
+	deep := Market{Bid: 99.9, Ask: 100, AskDepthPence: 1000000}
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		history   []float64
+		secondary float64
+		price     float64
+		market    Market
+		halted    bool
+	}{
+		{name: "first price", price: 100, market: deep},
+		{name: "within deviation", history: []float64{100, 101, 99}, price: 104, market: deep},
+		{name: "above deviation", history: []float64{100, 101, 99}, price: 106, market: deep, halted: true},
+		{name: "below deviation", history: []float64{100, 101, 99}, price: 94, market: deep, halted: true},
+		{name: "wide spread", price: 100, market: Market{Bid: 98, Ask: 100, AskDepthPence: 1000000}, halted: true},
+		{name: "shallow book", price: 100, market: Market{Bid: 99.9, Ask: 100, AskDepthPence: 99999}, halted: true},
+		{name: "agrees with secondary", secondary: 98, price: 100, market: deep},
+		{name: "disagrees with secondary", secondary: 96, price: 100, market: deep, halted: true},
+	}
+
+	for _, test := range tests {
+		subject := newTestGuard()
+		if test.secondary > 0 {
+			subject.secondary = &MockPriceSource{Price: test.secondary}
+		}
+		for _, p := range test.history {
+			if err := subject.Check(p, deep, now.Add(-time.Minute)); err != nil {
+				t.Fatalf("%s: history: %v", test.name, err)
+			}
+		}
+
+		err := subject.Check(test.price, test.market, now)
+
+		if test.halted != (KindOf(err) == KindHalted) || test.halted != (subject.Halted() != nil) {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.halted && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestPriceGuardForgetsOldPrices(t *testing.T) {
+	subject := newTestGuard()
+	now := time.Now()
+
+	if err := subject.Check(100, Market{Bid: 100, Ask: 100, AskDepthPence: 1000000}, now.Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := subject.Check(200, Market{Bid: 200, Ask: 200, AskDepthPence: 1000000}, now); err != nil {
+		t.Errorf("price outside the window was used: %v", err)
+	}
+}
+
+func TestPriceGuardSecondaryFailureDoesNotHalt(t *testing.T) {
+	subject := newTestGuard()
+	subject.secondary = &MockPriceSource{Err: errors.New("unavailable")}
+
+	err := subject.Check(100, Market{Bid: 100, Ask: 100, AskDepthPence: 1000000}, time.Now())
+	if !IsTransient(err) || subject.Halted() != nil {
+		t.Errorf("expected transient error, got %v", err)
+	}
+}
+
+func TestPriceGuardHaltSurvivesRestart(t *testing.T) {
+	f, err := ioutil.TempFile("", "halted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	defer os.Remove(f.Name())
+
+	subject := newTestGuard()
+	subject.file = f.Name()
+	subject.Check(100, Market{Bid: 90, Ask: 100, AskDepthPence: 1000000}, time.Now())
+
+	restarted := newTestGuard()
+	restarted.file = f.Name()
+	if err := restarted.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.Halted() == nil || restarted.Halted().Reason != subject.Halted().Reason {
+		t.Fatalf("halt %+v", restarted.Halted())
+	}
+
+	if err := restarted.Reset("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("halt file not removed: %v", err)
+	}
+}
+
+func TestPriceGuardReferenceSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	deep := Market{Bid: 99.9, Ask: 100, AskDepthPence: 1000000}
+	now := time.Now()
+
+	subject := newTestGuard()
+	subject.historyFile = dir + "/prices.json"
+	for _, p := range []float64{100, 101, 99} {
+		if err := subject.Check(p, deep, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restarted := newTestGuard()
+	restarted.file = dir + "/halted.json"
+	restarted.historyFile = subject.historyFile
+	if err := restarted.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if ref := restarted.Reference(now); ref != 100 {
+		t.Fatalf("reference %f after restart", ref)
+	}
+
+	// The first price after a restart is still checked
+	if KindOf(restarted.Check(120, deep, now)) != KindHalted {
+		t.Fatal("first price after restart was not checked")
+	}
+
+	// Once reset the secondary source is the reference
+	restarted.secondary = &MockPriceSource{Price: 118}
+	if err := restarted.Reset("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if ref := restarted.Reference(now); ref != 118 {
+		t.Errorf("reference %f after reset", ref)
+	}
+}
+
+func TestQueueWaitsWhileHalted(t *testing.T) {
+	for _, refund := range []bool{false, true} {
+		subject, monzo, coinbase, cleanup := newTestQueue(t)
+		defer cleanup()
+
+		guard := newTestGuard()
+		subject.logic.guard = guard
+		subject.policy = &ErrorPolicy{RefundWhenHalted: refund}
+		coinbase.Market = &Market{Bid: 90, Ask: 100, AskDepthPence: 1000000}
+
+		if err := subject.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		order := newTestOrder(fmt.Sprintf("tx_halted%t", refund))
+		monzo.SetTransaction(order.Transaction)
+		if err := subject.ledger.Receive(&order); err != nil {
+			t.Fatal(err)
+		}
+		subject.Push(order.Id)
+		subject.Wait()
+
+		if guard.Halted() == nil {
+			t.Fatal("guard did not trip")
+		}
+
+		if refund {
+			o := waitForState(t, subject.ledger, order.Id, OrderRefunded)
+			if o.ReasonCode != ReasonHalted {
+				t.Errorf("reason %s", o.ReasonCode)
+			}
+			continue
+		}
+
+		o := waitForState(t, subject.ledger, order.Id, OrderValidated)
+		if o.Error != "" {
+			t.Errorf("waiting order has error %s", o.Error)
+		}
+
+		// Once the book is back to normal an operator lets trading resume
+		coinbase.Market = nil
+		ops := Operators{"alice": "secret"}
+		handler := ops.Require(PriceGuardHandler(subject, guard))
+
+		r := httptest.NewRequest("POST", "/admin/price-guard", nil)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusUnauthorized || guard.Halted() == nil {
+			t.Errorf("unauthenticated reset: %d", w.Code)
+		}
+
+		r.SetBasicAuth("alice", "secret")
+		w = httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusOK || guard.Halted() != nil {
+			t.Errorf("reset: %d", w.Code)
+		}
+
+		waitForState(t, subject.ledger, order.Id, OrderBooksBalanced)
+	}
+}
+
+func TestKrakenPriceSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/0/public/Ticker" || r.URL.Query().Get("pair") != "ETHGBP" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"error":[],"result":{"XETHZGBP":{"a":["1501.0","1","1.0"],"c":["1500.50","0.2"]}}}`))
+	}))
+	defer server.Close()
+
+	subject := KrakenPriceSource{root: server.URL + "/"}
+
+	price, err := subject.GetEtherPrice()
+	if err != nil || price != 1500.5 {
+		t.Errorf("price %f, %v", price, err)
+	}
+}
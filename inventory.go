@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+)
+
+// SyncInventory replaces our record of how much Ether we hold with the
+// balance on Coinbase, raising an incident if they had drifted further apart
+// than the tolerance
+func (q *Queue) SyncInventory() error {
+	expected, actual, err := q.logic.SyncEtherBalance()
+	if err != nil {
+		return err
+	}
+
+	diff := actual.Sub(expected)
+	if diff.Sign() < 0 {
+		diff = expected.Sub(actual)
+	}
+
+	log.Printf("Inventory synced from Coinbase: %s ETH, previously %s ETH", actual.Ether(), expected.Ether())
+
+	if q.inventorySynced && diff.Cmp(q.inventoryTolerance) > 0 {
+		RaiseIncident(fmt.Errorf("Ether inventory was %s ETH but Coinbase holds %s ETH", expected.Ether(), actual.Ether()))
+	}
+
+	// Our record starts at zero, so the first sync is not a discrepancy
+	q.inventorySynced = true
+	return nil
+}
+
+func (q *Queue) syncInventoryPeriodically() {
+	for q.sleep(q.inventorySync) {
+		HandleError(q.SyncInventory())
+	}
+}
+
+// InventoryBand is how much Ether we aim to hold on Coinbase so that orders
+// rarely have to wait for a purchase
+type InventoryBand struct {
+	Low  Wei
+	High Wei
+
+	// Sell Ether above the high watermark instead of just reporting it
+	SellExcess bool
+
+	// Only report what would be bought or sold
+	DryRun bool
+}
+
+// Rebalance buys or sells Ether to bring the inventory back to the middle of
+// the band if it has strayed outside it, moving the money between the float
+// and coinbase pots
+func (l *Logic) Rebalance(b *InventoryBand) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.CanTrade()
+	if err != nil {
+		log.Printf("Not rebalancing inventory: %s", err.Error())
+		return nil
+	}
+
+	target := Wei{v: new(big.Int).Rsh(b.Low.Add(b.High).Int(), 1)}
+
+	switch {
+	case l.etherBalance.Cmp(b.Low) < 0:
+		size := target.Sub(l.etherBalance)
+		if size.Cmp(l.minPurchase) < 0 {
+			size = l.minPurchase
+		}
+
+		log.Printf("Inventory %s ETH is below %s ETH, buying %s ETH", l.etherBalance.Ether(), b.Low.Ether(), size.Ether())
+		if b.DryRun {
+			return nil
+		}
+
+		// An order that has not finished in time is left to be found by the
+		// next inventory sync
+		err, fill := l.coinbase.BuyEther(EtherPurchase{Size: size})
+		if fill.Done() {
+			l.etherBalance = l.etherBalance.Add(fill.Size)
+			err2 := l.movePots("float", "coinbase", fill.CostPence())
+			if err2 != nil {
+				return err2
+			}
+		}
+		if err != nil {
+			return Transient(errors.New("Failed to top up inventory: " + err.Error()))
+		}
+
+	case l.etherBalance.Cmp(b.High) > 0:
+		size := l.etherBalance.Sub(target)
+
+		log.Printf("Inventory %s ETH is above %s ETH, selling %s ETH", l.etherBalance.Ether(), b.High.Ether(), size.Ether())
+		if b.DryRun || !b.SellExcess || size.Cmp(l.minPurchase) < 0 {
+			return nil
+		}
+
+		err, soldSize, proceeds := l.coinbase.SellEther(size)
+		if err != nil {
+			return Transient(errors.New("Failed to sell excess inventory: " + err.Error()))
+		}
+
+		l.etherBalance = l.etherBalance.Sub(soldSize)
+		err = l.movePots("coinbase", "float", proceeds)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// movePots moves money from one pot to another for a trade that was not made
+// for an order. If only the first move is made the pots are out until an
+// operator fixes them, so the error says which.
+func (l *Logic) movePots(from string, to string, amountPence int) error {
+	err := l.monzo.MoveToPot(from, -amountPence)
+	if err != nil {
+		return Transient(fmt.Errorf("Failed to move %d out of pot %s: %s", amountPence, from, err.Error()))
+	}
+
+	err = l.monzo.MoveToPot(to, amountPence)
+	if err != nil {
+		return Permanent(fmt.Errorf("Moved %d out of pot %s but failed to move it into pot %s: %s", amountPence, from, to, err.Error()))
+	}
+	return nil
+}
+
+func (q *Queue) rebalancePeriodically() {
+	for q.sleep(q.rebalance) {
+		HandleError(q.logic.Rebalance(q.band))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInventorySyncedFromCoinbase(t *testing.T) {
+	subject, monzo, coinbase, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	coinbase.BalanceEth, _ = ParseEther("1")
+	subject.inventorySync = time.Hour
+	subject.inventoryTolerance, _ = ParseEther("0.001")
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if subject.logic.etherBalance.Ether() != "1" {
+		t.Errorf("ether balance after start %s", subject.logic.etherBalance.Ether())
+	}
+
+	// There is enough Ether to fulfil the order without buying more
+	order := newTestOrder("tx_inventory")
+	monzo.SetTransaction(order.Transaction)
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(order.Id)
+	subject.Wait()
+
+	waitForState(t, subject.ledger, order.Id, OrderBooksBalanced)
+
+	if monzo.Pots["coinbase"] != 0 {
+		t.Errorf("bought ether: %v", monzo.Pots)
+	}
+
+	// Someone withdraws Ether behind our back
+	coinbase.BalanceEth, _ = ParseEther("0.5")
+	if err := subject.SyncInventory(); err != nil {
+		t.Fatal(err)
+	}
+
+	if subject.logic.etherBalance.Ether() != "0.5" {
+		t.Errorf("ether balance after sync %s", subject.logic.etherBalance.Ether())
+	}
+}
+
+func TestRebalanceKeepsInventoryWithinBand(t *testing.T) {
+	low, _ := ParseEther("0.5")
+	high, _ := ParseEther("1.5")
+
+	tests := []struct {
+		balance  string
+		sell     bool
+		dryRun   bool
+		expected string
+		float    int
+	}{
+		{"0.2", false, false, "1", -8000},
+		{"0.2", false, true, "0.2", 0},
+		{"1.2", true, false, "1.2", 0},
+		{"2", false, false, "2", 0},
+		{"2", true, false, "1", 10000},
+		{"2", true, true, "2", 0},
+	}
+
+	for _, test := range tests {
+		monzo := &MockMonzo{Pots: make(map[string]int)}
+		balance, _ := ParseEther(test.balance)
+		coinbase := &MockCoinbase{BalanceEth: balance, EtherPrice: 100}
+
+		subject := Logic{
+			coinbase:     coinbase,
+			monzo:        monzo,
+			etherBalance: balance,
+		}
+
+		err := subject.Rebalance(&InventoryBand{Low: low, High: high, SellExcess: test.sell, DryRun: test.dryRun})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if subject.EtherBalance().Ether() != test.expected || coinbase.BalanceEth.Ether() != test.expected {
+			t.Errorf("%+v: balance %s, coinbase %s", test, subject.EtherBalance().Ether(), coinbase.BalanceEth.Ether())
+		}
+		if monzo.Pots["float"] != test.float || monzo.Pots["coinbase"] != -test.float {
+			t.Errorf("%+v: pots %v", test, monzo.Pots)
+		}
+	}
+}
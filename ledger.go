@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type OrderState string
+
+const (
+	OrderReceived        OrderState = "received"
+	OrderValidated       OrderState = "validated"
+	OrderPriced          OrderState = "priced"
+	OrderInventoryBought OrderState = "inventory-bought"
+	OrderEtherSending    OrderState = "ether-sending"
+	OrderEtherSent       OrderState = "ether-sent"
+	OrderBooksBalanced   OrderState = "books-balanced"
+	OrderRefundPending   OrderState = "refund-pending"
+	OrderRefunded        OrderState = "refunded"
+	OrderRejected        OrderState = "rejected"
+
+	OrderAwaitingSettlement OrderState = "awaiting-settlement"
+	OrderCancelled          OrderState = "cancelled"
+	OrderHeld               OrderState = "held"
+
+	OrderRefundReview   OrderState = "refund-review"
+	OrderRefundDeclined OrderState = "refund-declined"
+)
+
+// The states an order may move to from each state. Once Ether has been sent
+// the order can no longer be refunded, unless Coinbase reports that the
+// withdrawal failed, in which case it goes back to be sent again.
+//
+// Orders that cannot be verified with Monzo are rejected and never refunded.
+// Orders whose payment is declined or reversed before we have sent Ether are
+// cancelled.
+//
+// Held orders wait for an operator to decide whether to fulfil, refund or
+// cancel them, as do refunds that could not be paid out. Refunds under review
+// wait for an operator to approve or decline them.
+var orderTransitions = map[OrderState][]OrderState{
+	"":                      {OrderReceived},
+	OrderReceived:           {OrderValidated, OrderRefundPending, OrderRejected, OrderAwaitingSettlement, OrderCancelled, OrderHeld},
+	OrderAwaitingSettlement: {OrderValidated, OrderRejected, OrderCancelled},
+	OrderHeld:               {OrderValidated, OrderRefundPending, OrderCancelled},
+	OrderValidated:          {OrderPriced, OrderRefundPending, OrderCancelled, OrderHeld},
+	OrderPriced:             {OrderInventoryBought, OrderRefundPending, OrderCancelled, OrderHeld},
+	OrderInventoryBought:    {OrderEtherSending, OrderEtherSent, OrderRefundPending, OrderCancelled, OrderHeld},
+	OrderEtherSending:       {OrderEtherSent, OrderInventoryBought},
+	OrderEtherSent:          {OrderBooksBalanced},
+	OrderRefundPending:      {OrderRefunded, OrderCancelled, OrderHeld, OrderRefundReview},
+	OrderRefundReview:       {OrderRefundPending, OrderRefundDeclined, OrderCancelled},
+}
+
+type OrderTransition struct {
+	State OrderState
+	Time  time.Time
+}
+
+func (o *Order) CanTransition(to OrderState) bool {
+	for _, s := range orderTransitions[o.State] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFinished reports whether the order has reached a state that needs no further work
+func (o *Order) IsFinished() bool {
+	return o.State != "" && len(orderTransitions[o.State]) == 0
+}
+
+func (o *Order) Transition(to OrderState) error {
+	if !o.CanTransition(to) {
+		return fmt.Errorf("Order %s cannot move from '%s' to '%s'", o.Id, o.State, to)
+	}
+	o.State = to
+	o.Transitions = append(o.Transitions, OrderTransition{State: to, Time: time.Now().UTC()})
+	return nil
+}
+
+var ErrDuplicateOrder = errors.New("Order has already been received")
+
+// Ledger persists every order to disk as a JSON file named after the order ID
+type Ledger struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func (l *Ledger) Init() error {
+	return os.MkdirAll(l.dir, 0755)
+}
+
+// Receive assigns the order an ID if it does not have one and records it as
+// received. Returns ErrDuplicateOrder if an order with the same ID already exists.
+func (l *Ledger) Receive(o *Order) error {
+	if o.Id == "" {
+		o.Id = strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+
+	received := *o
+	err := received.Transition(OrderReceived)
+	if err != nil {
+		return err
+	}
+	dat, err := json.MarshalIndent(&received, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Claim the ID atomically so a retried webhook can never be processed
+	// twice. The order is written to a temporary file first and then linked
+	// into place, so a crash never leaves a claim without the order in it.
+	f, err := ioutil.TempFile(l.dir, o.Id+".claim-")
+	if err != nil {
+		return errors.New("Failed to save order " + o.Id + ": " + err.Error())
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(dat)
+	err2 := f.Close()
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		return errors.New("Failed to save order " + o.Id + ": " + err.Error())
+	}
+
+	l.mu.Lock()
+	err = os.Link(f.Name(), l.filename(o.Id))
+	l.mu.Unlock()
+	if os.IsExist(err) {
+		return ErrDuplicateOrder
+	}
+	if err != nil {
+		return errors.New("Failed to save order " + o.Id + ": " + err.Error())
+	}
+
+	*o = received
+	return nil
+}
+
+// Record moves the order to a new state and saves it
+func (l *Ledger) Record(o *Order, to OrderState) error {
+	err := o.Transition(to)
+	if err != nil {
+		return err
+	}
+	return l.Save(o)
+}
+
+func (l *Ledger) Save(o *Order) error {
+	if o.Id == "" {
+		return errors.New("Cannot save an order without an ID")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := WriteJSONFile(l.filename(o.Id), o)
+	if err != nil {
+		return errors.New("Failed to save order " + o.Id + ": " + err.Error())
+	}
+
+	return nil
+}
+
+func (l *Ledger) Load(id string) (o Order, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	dat, err := ioutil.ReadFile(l.filename(id))
+	if err != nil {
+		return o, err
+	}
+
+	err = json.Unmarshal(dat, &o)
+	return o, err
+}
+
+// List loads every order in the ledger
+func (l *Ledger) List() ([]Order, error) {
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var orders []Order
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		o, err := l.Load(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			log.Printf("Failed to load order %s: %s", f.Name(), err.Error())
+			continue
+		}
+
+		orders = append(orders, o)
+	}
+
+	return orders, nil
+}
+
+func (l *Ledger) filename(id string) string {
+	return fmt.Sprintf("%s%s.json", l.dir, id)
+}
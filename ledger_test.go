@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestOrderTransitions(t *testing.T) {
+	o := Order{}
+
+	for _, s := range []OrderState{OrderReceived, OrderValidated, OrderPriced, OrderInventoryBought, OrderEtherSent, OrderBooksBalanced} {
+		if err := o.Transition(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(o.Transitions) != 6 {
+		t.Errorf("transitions %d", len(o.Transitions))
+	}
+
+	if o.Transition(OrderRefundPending) == nil {
+		t.Error("refunded a fulfilled order")
+	}
+
+	o = Order{State: OrderEtherSent}
+	if o.Transition(OrderRefundPending) == nil {
+		t.Error("refunded an order after sending ether")
+	}
+}
+
+func TestLedgerSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := Ledger{dir: dir + "/"}
+
+	o := Order{Amount: 1000, Currency: "GBP"}
+	if err := l.Receive(&o); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Record(&o, OrderRefundPending); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := l.Load(o.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.State != OrderRefundPending || loaded.Amount != 1000 || len(loaded.Transitions) != 2 {
+		t.Errorf("loaded order %v", loaded)
+	}
+}
+
+func TestLedgerRejectsDuplicateOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := Ledger{dir: dir + "/"}
+
+	o := Order{Id: "tx_00009exl5Ni96JK2NMC9c9"}
+	if err := l.Receive(&o); err != nil {
+		t.Fatal(err)
+	}
+
+	retry := Order{Id: "tx_00009exl5Ni96JK2NMC9c9"}
+	if err := l.Receive(&retry); err != ErrDuplicateOrder {
+		t.Errorf("expected duplicate order, got %v", err)
+	}
+}
+
+func TestLedgerReceiveIgnoresAbandonedClaims(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := Ledger{dir: dir + "/"}
+
+	// What a crash part way through writing a claim leaves behind
+	err = ioutil.WriteFile(l.filename("tx_crashed")+".claim-1", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders, err := l.List()
+	if err != nil || len(orders) != 0 {
+		t.Fatalf("expected no orders, got %v, %v", orders, err)
+	}
+
+	retry := Order{Id: "tx_crashed", Amount: 1000}
+	if err := l.Receive(&retry); err != nil {
+		t.Fatalf("retried webhook not received: %v", err)
+	}
+	if retry.State != OrderReceived {
+		t.Errorf("expected %s, got %s", OrderReceived, retry.State)
+	}
+
+	saved, err := l.Load("tx_crashed")
+	if err != nil || saved.State != OrderReceived || saved.Amount != 1000 {
+		t.Errorf("claim does not hold the order: %+v, %v", saved, err)
+	}
+
+	if err := l.Receive(&Order{Id: "tx_crashed"}); err != ErrDuplicateOrder {
+		t.Errorf("expected ErrDuplicateOrder, got %v", err)
+	}
+}
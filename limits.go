@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type VelocityLimit struct {
+	Name     string
+	Period   time.Duration
+	MaxPence int
+}
+
+// VelocityLimits caps how much a customer can spend over rolling periods, so
+// the per transaction limit cannot be avoided by making lots of payments. A
+// customer is identified both by the bank account they pay from and by the
+// Ethereum address they pay to.
+type VelocityLimits struct {
+	Limits []VelocityLimit
+}
+
+// Check returns an error describing the first limit that the order breaks,
+// given all of the orders received so far
+func (v *VelocityLimits) Check(o *Order, history []Order, now time.Time) error {
+	for _, limit := range v.Limits {
+		byAccount := o.LegAmount()
+		byAddress := o.LegAmount()
+
+		for _, h := range history {
+			if h.Id == o.Id || !countsTowardsLimits(h) || len(h.Transitions) == 0 {
+				continue
+			}
+			if now.Sub(h.Transitions[0].Time) > limit.Period {
+				continue
+			}
+
+			if h.SortCode == o.SortCode && h.AccountNumber == o.AccountNumber {
+				byAccount += h.LegAmount()
+			}
+			if h.EthAddress == o.EthAddress {
+				byAddress += h.LegAmount()
+			}
+		}
+
+		if byAccount > limit.MaxPence || byAddress > limit.MaxPence {
+			return LimitExceededError(fmt.Sprintf("Limit exceeded. Send at most £%d per %s", limit.MaxPence/100, limit.Name))
+		}
+	}
+
+	return nil
+}
+
+// MaxGBP returns the most that can be spent per the named period, or zero if
+// there is no such limit
+func (v *VelocityLimits) MaxGBP(name string) int {
+	for _, limit := range v.Limits {
+		if limit.Name == name {
+			return limit.MaxPence / 100
+		}
+	}
+	return 0
+}
+
+// countsTowardsLimits reports whether we have accepted the order's payment
+func countsTowardsLimits(o Order) bool {
+	switch o.State {
+	case OrderAwaitingSettlement, OrderValidated, OrderPriced, OrderInventoryBought, OrderEtherSending, OrderEtherSent, OrderBooksBalanced:
+		return true
+	}
+	return false
+}
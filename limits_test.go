@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	eth "github.com/ethereum/go-ethereum/common"
+)
+
+func TestVelocityLimits(t *testing.T) {
+	now := time.Now()
+
+	limits := VelocityLimits{
+		Limits: []VelocityLimit{
+			{Name: "day", Period: 24 * time.Hour, MaxPence: 10000},
+			{Name: "week", Period: 7 * 24 * time.Hour, MaxPence: 20000},
+		},
+	}
+
+	past := func(id string, ago time.Duration, state OrderState, sortCode string, address string) Order {
+		return Order{
+			Id:            id,
+			SortCode:      sortCode,
+			AccountNumber: "12345678",
+			Amount:        5000,
+			EthAddress:    eth.HexToAddress(address),
+			State:         state,
+			Transitions:   []OrderTransition{{State: OrderReceived, Time: now.Add(-ago)}},
+		}
+	}
+
+	customer := "0x52Ec249dD2eEc428b1E2f389c7d032caF5D1a238"
+	other := "0xDaEF995931D6F00F56226b29ba70353327b21E00"
+
+	order := past("tx_new", 0, OrderReceived, "123456", customer)
+
+	tests := []struct {
+		name    string
+		history []Order
+		ok      bool
+	}{
+		{"no history", nil, true},
+		{"one earlier payment today", []Order{past("tx_1", time.Hour, OrderBooksBalanced, "123456", customer)}, true},
+		{"daily limit by account", []Order{
+			past("tx_1", time.Hour, OrderBooksBalanced, "123456", other),
+			past("tx_2", 2*time.Hour, OrderValidated, "123456", other),
+		}, false},
+		{"daily limit by address", []Order{
+			past("tx_1", time.Hour, OrderBooksBalanced, "654321", customer),
+			past("tx_2", 2*time.Hour, OrderBooksBalanced, "111111", customer),
+		}, false},
+		{"refunded payments do not count", []Order{
+			past("tx_1", time.Hour, OrderRefunded, "123456", customer),
+			past("tx_2", 2*time.Hour, OrderRefunded, "123456", customer),
+		}, true},
+		{"weekly limit", []Order{
+			past("tx_1", 2*24*time.Hour, OrderBooksBalanced, "123456", customer),
+			past("tx_2", 3*24*time.Hour, OrderBooksBalanced, "123456", customer),
+			past("tx_3", 4*24*time.Hour, OrderBooksBalanced, "123456", customer),
+			past("tx_4", 5*24*time.Hour, OrderBooksBalanced, "123456", customer),
+		}, false},
+		{"old payments expire", []Order{
+			past("tx_1", 8*24*time.Hour, OrderBooksBalanced, "123456", customer),
+			past("tx_2", 9*24*time.Hour, OrderBooksBalanced, "123456", customer),
+			past("tx_3", 10*24*time.Hour, OrderBooksBalanced, "123456", customer),
+		}, true},
+	}
+
+	for _, test := range tests {
+		err := limits.Check(&order, test.history, now)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestQueueHoldsOverLimitOrders(t *testing.T) {
+	subject, monzo, _, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	subject.limits = &VelocityLimits{
+		Limits: []VelocityLimit{{Name: "day", Period: 24 * time.Hour, MaxPence: 1500}},
+	}
+	subject.policy.HoldOverLimit = true
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	first := newTestOrder("tx_first")
+	second := newTestOrder("tx_second")
+
+	for _, o := range []Order{first, second} {
+		monzo.SetTransaction(o.Transaction)
+		if err := subject.ledger.Receive(&o); err != nil {
+			t.Fatal(err)
+		}
+		subject.Push(o.Id)
+		subject.Wait()
+	}
+
+	waitForState(t, subject.ledger, first.Id, OrderBooksBalanced)
+	waitForState(t, subject.ledger, second.Id, OrderHeld)
+}
+
+func TestVelocityLimitsMaxGBP(t *testing.T) {
+	subject := VelocityLimits{Limits: []VelocityLimit{{Name: "day", Period: 24 * time.Hour, MaxPence: 15000}}}
+
+	if subject.MaxGBP("day") != 150 || subject.MaxGBP("week") != 0 {
+		t.Errorf("got %d a day and %d a week", subject.MaxGBP("day"), subject.MaxGBP("week"))
+	}
+}
@@ -1,68 +1,534 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	eth "github.com/ethereum/go-ethereum/common"
 )
 
 type Logic struct {
-	etherBalance float64
-	coinbase     ICoinbase
-	monzo        IMonzo
+	// Only one order at a time may be fulfilled, so that two orders can never
+	// both spend the same Ether. Guards etherBalance.
+	mu           sync.Mutex
+	etherBalance Wei
+
+	coinbase ICoinbase
+	monzo    IMonzo
+	ledger   *Ledger
+
+	// The number of times sending an order's Ether may fail before the order
+	// is given up on. Zero means keep trying.
+	maxSendFailures int
+
+	// Extra Ether to buy whenever we run short, and the smallest amount the
+	// exchange will sell
+	purchaseBuffer Wei
+	minPurchase    Wei
+
+	// Decides the commission on each order. Defaults to DefaultFeeSchedule.
+	fees *FeeSchedule
+
+	// Quotes customers have been given, and how long they are valid for. A
+	// payment that misses its quote is priced live unless refundStaleQuotes.
+	quotes            *QuoteBook
+	quoteValidity     time.Duration
+	refundStaleQuotes bool
+
+	// Halts trading if a price looks wrong. Nil means prices are not checked.
+	guard *PriceGuard
+
+	// Lets an operator pause trading. Nil means trading is never paused.
+	maintenance *Maintenance
+
+	// Pays refunds out to the customer. Without one, refunds are deposited in
+	// the Refund pot to be paid out by hand.
+	bank IBank
 }
 
-func (l *Logic) Fulfill(o Order) error {
+// Fulfill takes a validated order through to completion. Each step is recorded
+// in the ledger, so an order that failed part way through can be passed back in
+// and will resume from the step it stopped at. Orders are fulfilled one at a
+// time.
+func (l *Logic) Fulfill(o *Order) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Never send Ether to the zero address, which nobody can spend from
+	if o.EthAddress == (eth.Address{}) {
+		return Permanent(errors.New("Order " + o.Id + " has no Ethereum address"))
+	}
+
+	if o.State == OrderValidated {
+
+		// Not even quoted orders are fulfilled while trading is stopped
+		err := l.CanTrade()
+		if err != nil {
+			return err
+		}
+
+		quote, err := l.quoteFor(o)
+		if err != nil {
+			return err
+		}
+
+		if quote != nil {
+			log.Printf("Order %s priced at quote: Price: %f, Amount E: %s", o.Id, quote.EtherPrice, quote.EtherAmount.Ether())
+
+			o.EtherPrice = quote.EtherPrice
+			o.Fees = quote.Fees
+			o.Commission = quote.Fees.TotalPence
+			o.EtherAmount = quote.EtherAmount
+			o.Quoted = true
+		} else {
+			var fees FeeBreakdown
+			o.EtherPrice, fees, o.EtherAmount, err = l.Price(o.LegAmount())
+			if err != nil {
+				return err
+			}
+			o.Fees = &fees
+			o.Commission = fees.TotalPence
+		}
+
+		// Note the Ether the payment bought that was rounded off the amount sent
+		exact, err := EtherForPence(o.LegAmount()-o.Commission, o.EtherPrice)
+		if err != nil {
+			return err
+		}
+		o.EtherRoundedOff = exact.Sub(o.EtherAmount)
+
+		err = l.ledger.Record(o, OrderPriced)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.State == OrderPriced {
+
+		// pay for purchases whose cost could not be moved when we last tried
+		for _, fill := range o.Purchases {
+			if fill.Done() {
+				err := l.payForPurchase(o, fill)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// finish a purchase that was still being filled when we last tried
+		if n := len(o.Purchases); n > 0 && !o.Purchases[n-1].Done() {
+			err, fill := l.coinbase.GetFill(o.Purchases[n-1].OrderId)
+			err = l.recordPurchase(o, fill, err)
+			if err != nil {
+				return err
+			}
+		}
+
+		// while E > ether balance
+		for o.EtherAmount.Cmp(l.etherBalance) > 0 {
+
+			log.Printf("Balance E: %s, Buying Ether", l.etherBalance.Ether())
+
+			// buy the shortfall plus a buffer, but no less than the exchange allows
+			size := o.EtherAmount.Sub(l.etherBalance).Add(l.purchaseBuffer)
+			if size.Cmp(l.minPurchase) < 0 {
+				size = l.minPurchase
+			}
+
+			// a partly filled purchase is made up on the next time round
+			err, fill := l.coinbase.BuyEther(EtherPurchase{Size: size})
+			err = l.recordPurchase(o, fill, err)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := l.ledger.Record(o, OrderInventoryBought)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.State == OrderInventoryBought {
+
+		log.Printf("Balance E: %s, Sending Ether", l.etherBalance.Ether())
+
+		// send ether to user
+		sendTime := time.Now().Add(-WithdrawalClockSkew)
+		withdrawalId, err := l.coinbase.SendEther(o.EtherAmount, o.EthAddress)
+		if err != nil && KindOf(err) != KindSendRejected {
+			// Coinbase may have made the withdrawal before the request failed,
+			// so sending again could pay the customer twice
+			withdrawalId, err = l.findWithdrawal(o, sendTime, err)
+		}
+		if err != nil {
+			if KindOf(err) == KindSendUncertain {
+				return err
+			}
+
+			// The Ether was never sent so it is still in our inventory
+			o.SendFailures++
+			err2 := l.ledger.Save(o)
+			if err2 != nil {
+				return errors.New("Failed to record failed send: " + err2.Error() + ". Original error: " + err.Error())
+			}
+
+			if l.maxSendFailures > 0 && o.SendFailures >= l.maxSendFailures {
+				return DeliveryFailedError(fmt.Sprintf("Failed to send Ether %d times: %s", o.SendFailures, err.Error()))
+			}
+			return Transient(errors.New("Failed to send Ether: " + err.Error()))
+		}
+
+		// adjust ether balance
+		l.etherBalance = l.etherBalance.Sub(o.EtherAmount)
+
+		o.WithdrawalId = withdrawalId
+		err = l.ledger.Record(o, OrderEtherSending)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.State == OrderEtherSending {
+
+		w, err := l.coinbase.GetWithdrawal(o.WithdrawalId)
+		if err != nil {
+			return Transient(err)
+		}
+
+		switch w.Status {
+		case WithdrawalFailed:
+			// Coinbase gives the Ether back, so send it again. The balance is
+			// read rather than added to in case a sync has already counted it.
+			balance, err2 := l.coinbase.GetEtherBalance()
+			if err2 != nil {
+				return Transient(err2)
+			}
+			l.etherBalance = balance
+
+			o.SendFailures++
+			err = l.ledger.Record(o, OrderInventoryBought)
+			if err != nil {
+				return err
+			}
+
+			msg := fmt.Sprintf("Coinbase withdrawal %s failed", o.WithdrawalId)
+			if l.maxSendFailures > 0 && o.SendFailures >= l.maxSendFailures {
+				return DeliveryFailedError(fmt.Sprintf("Failed to send Ether %d times: %s", o.SendFailures, msg))
+			}
+			return Transient(errors.New(msg))
+
+		case WithdrawalCompleted:
+			log.Printf("Order %s withdrawal %s completed: tx %s, fee %s ETH", o.Id, o.WithdrawalId, w.TxHash, w.Fee.Ether())
 
-	// get ether price
-	etherPrice, err := l.coinbase.GetEtherPrice()
+			o.TxHash = w.TxHash
+			o.WithdrawalFee = w.Fee
+			err = l.ledger.Record(o, OrderEtherSent)
+			if err != nil {
+				return err
+			}
+
+		default:
+			// The queue checks again later
+			log.Printf("Order %s withdrawal %s is %s", o.Id, o.WithdrawalId, w.Status)
+			return nil
+		}
+	}
+
+	// Money only moves between pots once the Ether has been delivered
+	if o.State == OrderEtherSent {
+
+		// add (payment - commission) to float
+		err := l.moveToPot(o, "books-float", "float", o.LegAmount()-o.Commission)
+		if err != nil {
+			return err
+		}
+
+		// add commission to profit
+		err = l.moveToPot(o, "books-profit", "profit", o.Commission)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Balance E: %s", l.etherBalance.Ether())
+
+		return l.ledger.Record(o, OrderBooksBalanced)
+	}
+
+	return nil
+}
+
+// findWithdrawal looks for a withdrawal that a failed SendEther may have made
+// anyway. If there is none the order is left for an operator to check, as
+// Coinbase may not have listed it yet.
+func (l *Logic) findWithdrawal(o *Order, since time.Time, sendErr error) (string, error) {
+	withdrawalId, err := l.coinbase.FindWithdrawal(o.EtherAmount, o.EthAddress, since)
+	if err != nil {
+		return "", SendUncertainError(fmt.Sprintf("Failed to send Ether: %s. Failed to check whether it was sent: %s", sendErr.Error(), err.Error()))
+	}
+	if withdrawalId == "" {
+		return "", SendUncertainError(fmt.Sprintf("Failed to send Ether and found no withdrawal, check Coinbase before releasing the order: %s", sendErr.Error()))
+	}
+
+	log.Printf("Order %s send failed but Coinbase made withdrawal %s: %s", o.Id, withdrawalId, sendErr.Error())
+	return withdrawalId, nil
+}
+
+// recordPurchase saves what a purchase made for the order did, and adds any
+// Ether it bought to the inventory once it has finished. A purchase that has
+// not finished is saved so that it can be waited for on the next attempt
+// rather than placed again.
+func (l *Logic) recordPurchase(o *Order, fill Fill, err error) error {
+	if fill.OrderId == "" {
+		// the order was never placed
+		return Transient(err)
+	}
+
+	n := len(o.Purchases)
+	if n > 0 && o.Purchases[n-1].OrderId == fill.OrderId {
+		o.Purchases[n-1] = fill
+	} else {
+		o.Purchases = append(o.Purchases, fill)
+	}
+
+	err2 := l.ledger.Save(o)
+	if err2 != nil {
+		return errors.New("Failed to record purchase " + fill.OrderId + ": " + err2.Error())
+	}
+
+	if !fill.Done() {
+		if err == nil {
+			err = fmt.Errorf("Coinbase order %s is still %s", fill.OrderId, fill.Status)
+		}
+		return Transient(err)
+	}
+
+	// increase ether balance
+	l.etherBalance = l.etherBalance.Add(fill.Size)
+
+	err2 = l.payForPurchase(o, fill)
+	if err2 != nil {
+		return err2
+	}
+
+	if err != nil {
+		return Transient(err)
+	}
+	return nil
+}
+
+// payForPurchase sends what a finished purchase cost from float to coinbase
+func (l *Logic) payForPurchase(o *Order, fill Fill) error {
+	err := l.moveToPot(o, "purchase-"+fill.OrderId+"-float", "float", -fill.CostPence())
 	if err != nil {
 		return err
 	}
+	return l.moveToPot(o, "purchase-"+fill.OrderId+"-coinbase", "coinbase", fill.CostPence())
+}
+
+// moveToPot moves money into a pot for the order unless the move with the
+// given key has already been made. Each move is saved as soon as it is made,
+// so the queue can retry a failed one without repeating those before it.
+func (l *Logic) moveToPot(o *Order, key string, pot string, amountPence int) error {
+	for _, k := range o.PotMoves {
+		if k == key {
+			return nil
+		}
+	}
 
-	// get ether amount to fulfill E
-	commission := int(float64(o.Amount) * 0.15)
-	etherValueGbp := float64(o.Amount-commission) / 100.0
-	etherAmount := etherValueGbp / etherPrice
+	err := l.monzo.MoveToPot(pot, amountPence)
+	if err != nil {
+		return Transient(errors.New("Failed to move " + strconv.Itoa(amountPence) + " into pot " + pot + ": " + err.Error()))
+	}
 
-	log.Printf("Amount O: %d, Commission: %d, Price: %f, Value: %f, Amount E: %f",
-		o.Amount, commission, etherPrice, etherValueGbp, etherAmount)
+	o.PotMoves = append(o.PotMoves, key)
+	err = l.ledger.Save(o)
+	if err != nil {
+		return errors.New("Failed to record move into pot " + pot + ": " + err.Error())
+	}
+	return nil
+}
 
-	// while E > ether balance
-	for etherAmount > l.etherBalance {
+// CanTrade returns an error if an operator has paused trading or the price
+// guard has halted it
+func (l *Logic) CanTrade() error {
+	if l.maintenance != nil {
+		if p := l.maintenance.Paused(); p != nil {
+			return PausedError("Trading paused: " + p.Reason)
+		}
+	}
+	if l.guard != nil {
+		if h := l.guard.Halted(); h != nil {
+			return HaltedError("Trading halted: " + h.Reason)
+		}
+	}
+	return nil
+}
 
-		log.Printf("Balance E: %f, Buying Ether", l.etherBalance)
+// EtherBalance returns how much Ether we believe we hold on Coinbase
+func (l *Logic) EtherBalance() Wei {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.etherBalance
+}
+
+// SyncEtherBalance replaces our record of how much Ether we hold with the
+// balance on Coinbase. Returns both.
+func (l *Logic) SyncEtherBalance() (previous Wei, actual Wei, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	actual, err = l.coinbase.GetEtherBalance()
+	if err != nil {
+		return previous, actual, Transient(err)
+	}
+
+	previous = l.etherBalance
+	l.etherBalance = actual
+	return previous, actual, nil
+}
+
+// Price works out how much Ether a payment buys at the current rate
+func (l *Logic) Price(amountPence int) (etherPrice float64, fees FeeBreakdown, etherAmount Wei, err error) {
+
+	schedule := l.fees
+	if schedule == nil {
+		schedule = &DefaultFeeSchedule
+	}
 
-		// buy £10 worth ether
-		err, filledSize := l.coinbase.BuyEther()
+	fees, err = schedule.Calculate(amountPence)
+	if err != nil {
+		return 0, fees, Wei{}, err
+	}
+
+	// get the price of the Ether the rest of the payment will buy
+	etherPrice, err = l.coinbase.GetEtherPrice(amountPence - fees.TotalPence)
+	if err != nil {
+		return 0, fees, Wei{}, Transient(err)
+	}
+
+	market, err := l.coinbase.GetMarket()
+	if err != nil {
+		return 0, fees, Wei{}, Transient(err)
+	}
+
+	// refuse to trade at a price that looks wrong
+	if l.guard != nil {
+		err = l.guard.Check(etherPrice, market, time.Now())
 		if err != nil {
-			return err
+			return 0, fees, Wei{}, err
 		}
+	}
 
-		// increase ether balance
-		l.etherBalance += filledSize
+	schedule.AddSpread(&fees, amountPence, etherPrice, market.Mid())
+	etherValuePence := amountPence - fees.TotalPence
 
-		// send 10 from float to coinbase
-		l.monzo.MoveToPot("float", -1000)
-		l.monzo.MoveToPot("coinbase", 1000)
+	// get ether amount to fulfill E, rounded down to the smallest amount
+	// Coinbase sends so that what we record, quote and send all match. This
+	// takes less than 10^(18-CoinbaseSizeDecimals) wei off the amount.
+	etherAmount, err = EtherForPence(etherValuePence, etherPrice)
+	if err != nil {
+		return 0, fees, Wei{}, err
 	}
+	etherAmount = etherAmount.RoundDown(CoinbaseSizeDecimals)
 
-	log.Printf("Balance E: %f, Sending Ether", l.etherBalance)
+	log.Printf("Amount O: %d, Commission: %d (%+v), Price: %f, Value: %d, Amount E: %s",
+		amountPence, fees.TotalPence, fees, etherPrice, etherValuePence, etherAmount.Ether())
 
-	// send ether to user
-	etherAmountStr := fmt.Sprintf("%f", etherAmount)
-	//log.Printf("Send %s ether to user", etherAmountStr)
-	l.coinbase.SendEther(etherAmountStr, o.EthAddress)
+	return etherPrice, fees, etherAmount, nil
+}
+
+// Refund returns the customer's payment and records the order as refunded. The
+// original error is returned so the caller can report it.
+func (l *Logic) Refund(tx *Order, err error) error {
+
+	if tx.State != OrderRefundPending {
+		tx.SetError(err)
 
-	// adjust ether balance
-	l.etherBalance -= etherAmount
+		err2 := l.ledger.Record(tx, OrderRefundPending)
+		if err2 != nil {
+			return errors.New("Failed to record refund: " + err2.Error() + ". Original error: " + err.Error())
+		}
+	}
 
-	// add (payment - commission) to float
-	l.monzo.MoveToPot("float", o.Amount-commission)
+	if tx.SortCode == "" || tx.AccountNumber == "" || tx.Currency == "" {
+		return CounterpartyMissingError("An error occurred but we do not have enough information to issue a refund: " + err.Error())
+	}
 
-	// add commission to profit
-	l.monzo.MoveToPot("profit", commission)
+	l.monzo.PostInfo("REFUND", fmt.Sprintf("%s %s %d %s %s %s", tx.SortCode, tx.AccountNumber, tx.RefundAmount(), tx.Currency, tx.ReasonCode, err.Error()))
+
+	if l.bank != nil {
+		err2 := l.payOut(tx)
+		if err2 != nil {
+			// Keep the kind so a transient failure is retried and a permanent one escalated
+			e := AsOrderError(err2)
+			return &OrderError{Kind: e.Kind, Reason: e.Reason, Message: "Failed to pay refund: " + err2.Error() + ". Original error: " + err.Error()}
+		}
+	} else {
+		err2 := l.moveToPot(tx, "refund", "refund", tx.RefundAmount())
+
+		if err2 != nil {
+			return Transient(errors.New("Failed to deposit into Refund pot: " + err2.Error() + ". Original error: " + err.Error()))
+		}
+	}
+
+	// add any fee the operator deducted to profit
+	if fee := tx.LegAmount() - tx.RefundAmount(); fee > 0 {
+		err2 := l.moveToPot(tx, "refund-fee", "profit", fee)
+		if err2 != nil {
+			return Transient(errors.New("Failed to deposit refund fee into Profit pot: " + err2.Error() + ". Original error: " + err.Error()))
+		}
+	}
+
+	err2 := l.ledger.Record(tx, OrderRefunded)
+	if err2 != nil {
+		return errors.New("Failed to record refund: " + err2.Error() + ". Original error: " + err.Error())
+	}
+
+	return err
+}
+
+// payOut pays the refund back to the account it came from. The payee is saved
+// before paying and the order ID is the payment's idempotency key, so a retried
+// refund never pays the customer twice.
+func (l *Logic) payOut(tx *Order) error {
+	if tx.RefundPayeeId == "" {
+		payeeId, err := l.bank.CreatePayee(tx.Transaction.CounterParty.Name, tx.SortCode, tx.AccountNumber)
+		if err != nil {
+			return err
+		}
+
+		tx.RefundPayeeId = payeeId
+		err = l.ledger.Save(tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	reference := tx.ReasonCode
+	if len(reference) > RefundReferenceLength {
+		reference = reference[:RefundReferenceLength]
+	}
+
+	paymentId, err := l.bank.Pay(BankPayment{
+		PayeeId:        tx.RefundPayeeId,
+		AmountPence:    tx.RefundAmount(),
+		Currency:       tx.Currency,
+		Reference:      reference,
+		IdempotencyKey: "refund-" + tx.Id,
+	})
+	if err != nil {
+		return err
+	}
 
-	log.Printf("Balance E: %f", l.etherBalance)
+	log.Printf("Refunded order %s with payment %s", tx.Id, paymentId)
 
+	tx.RefundPaymentId = paymentId
+	tx.RefundReference = reference
 	return nil
 }
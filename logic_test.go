@@ -1,69 +1,319 @@
 package main
 
 import (
-	"math"
-	"strconv"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	eth "github.com/ethereum/go-ethereum/common"
 )
 
 type MockMonzo struct {
-	Pots    map[string]int
-	Balance int
+	Pots         map[string]int
+	Balance      int
+	Transactions map[string]MonzoWebHookTransaction
+	mu           sync.Mutex
+
+	// Fail every MoveFailEvery'th move into a pot, if not zero
+	MoveFailEvery int
+	moves         int
 }
 
 type MockCoinbase struct {
-	EtherPrice  float64
-	BalanceGbp  float64
-	BalanceEth  float64
-	EthAccounts map[string]float64
+	EtherPrice   float64
+	BalancePence int
+	BalanceEth   Wei
+	EthAccounts  map[string]Wei
+
+	// The number of times GetEtherPrice should fail before succeeding
+	PriceFailures int
+
+	// The number of times SendEther should be rejected before succeeding, and
+	// the number of times it should fail with no answer, either before or
+	// after making the withdrawal
+	SendFailures  int
+	NoAnswerSends int
+	LostSends     int
+
+	// The number of times GetWithdrawal should report a withdrawal pending
+	// before it completes, and the number of withdrawals that should fail
+	// after they have been made
+	PendingWithdrawals int
+	FailedWithdrawals  int
+	withdrawals        map[string]*mockWithdrawal
+
+	// The book returned by GetMarket. Defaults to a tight, deep book around
+	// EtherPrice.
+	Market *Market
+
+	// The number of purchases that should only be half filled, and that should
+	// not finish before BuyEther gives up waiting, and the fee on each purchase
+	PartialFills int
+	SlowFills    int
+	FeePence     int
+	unfinished   map[string]Fill
+
+	Purchases []EtherPurchase
+	Sales     []Wei
+
+	// How long each trade or withdrawal takes, and how many times one started
+	// while another was still going on
+	Delay    time.Duration
+	active   int32
+	Overlaps int32
+}
+
+type mockWithdrawal struct {
+	n      int
+	amount Wei
+	to     string
+	fail   bool
+	time   time.Time
+}
+
+// trade stands in for a call to the exchange. Call the returned function
+// when the call is finished.
+func (c *MockCoinbase) trade() func() {
+	if atomic.AddInt32(&c.active, 1) > 1 {
+		atomic.AddInt32(&c.Overlaps, 1)
+	}
+	time.Sleep(c.Delay)
+	return func() {
+		atomic.AddInt32(&c.active, -1)
+	}
 }
 
 func (m *MockMonzo) MoveToPot(potName string, amountPence int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.moves++
+	if m.MoveFailEvery > 0 && m.moves%m.MoveFailEvery == 0 {
+		return errors.New("monzo unavailable")
+	}
+
 	m.Balance -= amountPence
 	m.Pots[potName] += amountPence
 	return nil
 }
 
-func (c *MockCoinbase) BuyEther() (err error, filledSize float64) {
-	c.BalanceGbp -= EtherValueGBP
-	filledSize = EtherValueGBP / c.EtherPrice
-	c.BalanceEth += filledSize
-	return nil, filledSize
+func (m *MockMonzo) PostInfo(heading string, msg string) error {
+	return nil
+}
+
+func (m *MockMonzo) SetTransaction(tx MonzoWebHookTransaction) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Transactions == nil {
+		m.Transactions = make(map[string]MonzoWebHookTransaction)
+	}
+	m.Transactions[tx.Id] = tx
 }
 
-func (c *MockCoinbase) SendEther(amount string, to eth.Address) error {
-	amountFloat, _ := strconv.ParseFloat(amount, 64)
-	c.BalanceEth -= amountFloat
-	c.EthAccounts[to.String()] += amountFloat
-	return nil
+func (m *MockMonzo) GetTransaction(id string) (MonzoWebHookTransaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, ok := m.Transactions[id]
+	if !ok {
+		return tx, errors.New("Monzo transaction " + id + " does not exist")
+	}
+	return tx, nil
+}
+
+func (c *MockCoinbase) BuyEther(p EtherPurchase) (err error, fill Fill) {
+	defer c.trade()()
+
+	c.Purchases = append(c.Purchases, p)
+
+	fill = Fill{
+		OrderId:    fmt.Sprintf("mock-%d", len(c.Purchases)),
+		Status:     "done",
+		DoneReason: "filled",
+		Size:       p.Size,
+		ValuePence: p.FundsPence,
+		FeesPence:  c.FeePence,
+	}
+	if p.Size.Sign() > 0 {
+		fill.ValuePence = PenceForEther(p.Size, c.EtherPrice)
+	} else {
+		fill.Size, err = EtherForPence(p.FundsPence, c.EtherPrice)
+	}
+
+	if c.PartialFills > 0 {
+		c.PartialFills--
+		fill.Size = Wei{v: new(big.Int).Rsh(fill.Size.Int(), 1)}
+		fill.ValuePence = PenceForEther(fill.Size, c.EtherPrice)
+		fill.DoneReason = "canceled"
+	}
+
+	if c.SlowFills > 0 {
+		c.SlowFills--
+		if c.unfinished == nil {
+			c.unfinished = make(map[string]Fill)
+		}
+		c.unfinished[fill.OrderId] = fill
+		return errors.New("order still open"), Fill{OrderId: fill.OrderId, Status: "open"}
+	}
+
+	c.BalancePence -= fill.CostPence()
+	c.BalanceEth = c.BalanceEth.Add(fill.Size)
+	return err, fill
+}
+
+func (c *MockCoinbase) GetFill(orderId string) (err error, fill Fill) {
+	defer c.trade()()
+
+	fill, ok := c.unfinished[orderId]
+	if !ok {
+		return errors.New("unknown order " + orderId), Fill{}
+	}
+	delete(c.unfinished, orderId)
+
+	c.BalancePence -= fill.CostPence()
+	c.BalanceEth = c.BalanceEth.Add(fill.Size)
+	return nil, fill
+}
+
+func (c *MockCoinbase) SellEther(size Wei) (err error, soldSize Wei, proceedsPence int) {
+	defer c.trade()()
+
+	c.Sales = append(c.Sales, size)
+
+	proceedsPence = PenceForEther(size, c.EtherPrice)
+	c.BalancePence += proceedsPence
+	c.BalanceEth = c.BalanceEth.Sub(size)
+	return nil, size, proceedsPence
+}
+
+func (c *MockCoinbase) SendEther(amount Wei, to eth.Address) (withdrawalId string, err error) {
+	defer c.trade()()
+
+	if c.SendFailures > 0 {
+		c.SendFailures--
+		return "", SendRejectedError(errors.New("withdrawal failed"))
+	}
+
+	if c.NoAnswerSends > 0 {
+		c.NoAnswerSends--
+		return "", errors.New("timeout")
+	}
+
+	if amount.Cmp(c.BalanceEth) > 0 {
+		return "", SendRejectedError(errors.New("insufficient funds"))
+	}
+
+	if c.withdrawals == nil {
+		c.withdrawals = make(map[string]*mockWithdrawal)
+	}
+	w := &mockWithdrawal{n: len(c.withdrawals) + 1, amount: amount, to: to.String(), time: time.Now()}
+	withdrawalId = fmt.Sprintf("withdrawal-%d", w.n)
+	c.withdrawals[withdrawalId] = w
+
+	c.BalanceEth = c.BalanceEth.Sub(amount)
+	if c.FailedWithdrawals > 0 {
+		c.FailedWithdrawals--
+		w.fail = true
+	} else {
+		c.EthAccounts[w.to] = c.EthAccounts[w.to].Add(amount)
+	}
+
+	if c.LostSends > 0 {
+		c.LostSends--
+		return "", errors.New("timeout")
+	}
+	return withdrawalId, nil
 }
 
-func (c *MockCoinbase) GetEtherPrice() (float64, error) {
+func (c *MockCoinbase) FindWithdrawal(amount Wei, to eth.Address, since time.Time) (withdrawalId string, err error) {
+	defer c.trade()()
+
+	for id, w := range c.withdrawals {
+		if w.to == to.String() && w.amount.Cmp(amount) == 0 && !w.time.Before(since) {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+func (c *MockCoinbase) GetWithdrawal(id string) (Withdrawal, error) {
+	defer c.trade()()
+
+	w, ok := c.withdrawals[id]
+	if !ok {
+		return Withdrawal{}, errors.New("unknown withdrawal " + id)
+	}
+
+	if c.PendingWithdrawals > 0 {
+		c.PendingWithdrawals--
+		return Withdrawal{Id: id, Status: WithdrawalPending}, nil
+	}
+
+	if w.fail {
+		if w.amount.Sign() > 0 {
+			// Coinbase gives the Ether back once
+			c.BalanceEth = c.BalanceEth.Add(w.amount)
+			w.amount = Wei{}
+		}
+		return Withdrawal{Id: id, Status: WithdrawalFailed}, nil
+	}
+
+	return Withdrawal{
+		Id:     id,
+		Status: WithdrawalCompleted,
+		TxHash: fmt.Sprintf("0x%064x", w.n),
+		Fee:    NewWei(21000 * 1000000000),
+	}, nil
+}
+
+func (c *MockCoinbase) GetEtherBalance() (Wei, error) {
+	return c.BalanceEth, nil
+}
+
+func (c *MockCoinbase) GetEtherPrice(amountPence int) (float64, error) {
+	if c.PriceFailures > 0 {
+		c.PriceFailures--
+		return 0, errors.New("coinbase unavailable")
+	}
 	return c.EtherPrice, nil
 }
 
+func (c *MockCoinbase) GetMarket() (Market, error) {
+	if c.Market != nil {
+		return *c.Market, nil
+	}
+	return Market{Bid: c.EtherPrice, Ask: c.EtherPrice, AskDepthPence: MaxOrderPence * 1000}, nil
+}
+
 func TestOrderSmallerThanBalance(t *testing.T) {
-	Do(t, 10000, 1.0, 0, 1500, 8500, 0.15, 0.85)
+	Do(t, 10000, "1", 0, 1500, 8500, "0.15", "0.85")
 }
 
 func TestOrderLargerThanBalance(t *testing.T) {
-	Do(t, 1000, 0.0, 1000, 150, -150, 0.015, 0.085)
+	Do(t, 1000, "0", 850, 150, 0, "0", "0.085")
 }
 
 func TestOrderMuchLargerThanBalance(t *testing.T) {
-	Do(t, 10000, 0.0, 9000, 1500, -500, 0.05, 0.85)
+	Do(t, 10000, "0", 8500, 1500, 0, "0", "0.85")
 }
 
 func Do(
 	t *testing.T, orderSizePence int,
-	balanceEth float64,
+	balanceEther string,
 	expectedCoinbasePot int,
 	expectedProfitPot int,
 	expectedFloatPot int,
-	expectedEthBalance float64,
-	expectedCustomerEthBalance float64) {
+	expectedEthBalance string,
+	expectedCustomerEthBalance string) {
+
+	balanceEth, _ := ParseEther(balanceEther)
 
 	monzo := MockMonzo{
 		Pots:    make(map[string]int),
@@ -72,15 +322,21 @@ func Do(
 
 	coinbase := MockCoinbase{
 		BalanceEth:  balanceEth,
-		BalanceGbp:  0,
-		EthAccounts: make(map[string]float64),
+		EthAccounts: make(map[string]Wei),
 		EtherPrice:  100,
 	}
 
+	dir, err := ioutil.TempDir("", "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
 	subject := Logic{
 		coinbase:     &coinbase,
 		monzo:        &monzo,
 		etherBalance: balanceEth,
+		ledger:       &Ledger{dir: dir + "/"},
 	}
 
 	order := Order{
@@ -89,9 +345,15 @@ func Do(
 		Currency:      "GBP",
 		EthAddress:    eth.HexToAddress("0x52Ec249dD2eEc428b1E2f389c7d032caF5D1a238"),
 		SortCode:      "123456",
+		Id:            "tx_test",
+		State:         OrderValidated,
 	}
 
-	subject.Fulfill(order)
+	subject.Fulfill(&order)
+
+	if order.State != OrderBooksBalanced {
+		t.Errorf("order state %s", order.State)
+	}
 
 	if monzo.Pots["coinbase"] != expectedCoinbasePot {
 		t.Error("coinbase pot")
@@ -109,15 +371,342 @@ func Do(
 		t.Errorf("monzo balance %d", monzo.Balance)
 	}
 
-	if math.Abs(subject.etherBalance-expectedEthBalance) > 0.00001 {
-		t.Errorf("logic ether balance %f", subject.etherBalance)
+	if subject.etherBalance.Ether() != expectedEthBalance {
+		t.Errorf("logic ether balance %s", subject.etherBalance.Ether())
+	}
+
+	if coinbase.BalanceEth.Ether() != expectedEthBalance {
+		t.Errorf("coinbase ether balance %s", coinbase.BalanceEth.Ether())
+	}
+
+	if coinbase.EthAccounts["0x52Ec249dD2eEc428b1E2f389c7d032caF5D1a238"].Ether() != expectedCustomerEthBalance {
+		t.Error("customer eth balance")
+	}
+}
+
+func TestConcurrentOrdersNeverOversell(t *testing.T) {
+	monzo := MockMonzo{Pots: make(map[string]int)}
+
+	coinbase := MockCoinbase{
+		EthAccounts: make(map[string]Wei),
+		EtherPrice:  100,
+		Delay:       time.Millisecond,
+	}
+
+	dir, err := ioutil.TempDir("", "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	subject := Logic{
+		coinbase: &coinbase,
+		monzo:    &monzo,
+		ledger:   &Ledger{dir: dir + "/"},
+	}
+
+	const orders = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, orders)
+	for i := 0; i < orders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			o := newTestOrder(fmt.Sprintf("tx_concurrent%d", i))
+			o.EthAddress = eth.HexToAddress(fmt.Sprintf("0x%040x", i+1))
+			o.State = OrderValidated
+
+			err := subject.Fulfill(&o)
+			if err == nil && o.State != OrderBooksBalanced {
+				err = fmt.Errorf("order %s in state %s", o.Id, o.State)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if coinbase.Overlaps != 0 {
+		t.Errorf("%d trades overlapped", coinbase.Overlaps)
+	}
+
+	// Every customer got exactly what they paid for
+	expected, _ := ParseEther("0.085")
+	sent := Wei{}
+	for address, amount := range coinbase.EthAccounts {
+		if amount.Cmp(expected) != 0 {
+			t.Errorf("%s got %s", address, amount.Ether())
+		}
+		sent = sent.Add(amount)
+	}
+	if len(coinbase.EthAccounts) != orders {
+		t.Errorf("%d customers paid", len(coinbase.EthAccounts))
+	}
+
+	// Our record of the inventory matches the exchange and was never overspent
+	if subject.EtherBalance().Cmp(coinbase.BalanceEth) != 0 || coinbase.BalanceEth.Sign() < 0 {
+		t.Errorf("ether balance %s, coinbase %s", subject.EtherBalance().Ether(), coinbase.BalanceEth.Ether())
+	}
+
+	if monzo.Pots["profit"] != orders*150 {
+		t.Errorf("profit %d", monzo.Pots["profit"])
+	}
+}
+
+func TestFulfillBuysShortfallPlusBuffer(t *testing.T) {
+	tests := []struct {
+		amount    int
+		balance   string
+		buffer    string
+		minimum   string
+		purchases []string
+	}{
+		// one purchase for a large order however empty the inventory
+		{5000, "0", "0.01", "0.001", []string{"0.435"}},
+		{1000, "0.05", "0.01", "0.001", []string{"0.045"}},
+		// no less than the exchange will sell
+		{1000, "0.08", "0", "0.01", []string{"0.01"}},
+		{1000, "0.1", "0.01", "0.01", nil},
+	}
+
+	for _, test := range tests {
+		monzo := MockMonzo{Pots: make(map[string]int)}
+		balance, _ := ParseEther(test.balance)
+		coinbase := MockCoinbase{
+			BalanceEth:  balance,
+			EthAccounts: make(map[string]Wei),
+			EtherPrice:  100,
+		}
+
+		dir, err := ioutil.TempDir("", "orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		subject := Logic{
+			coinbase:     &coinbase,
+			monzo:        &monzo,
+			etherBalance: balance,
+			ledger:       &Ledger{dir: dir + "/"},
+		}
+		subject.purchaseBuffer, _ = ParseEther(test.buffer)
+		subject.minPurchase, _ = ParseEther(test.minimum)
+
+		o := newTestOrder("tx_shortfall")
+		o.Amount = test.amount
+		o.State = OrderValidated
+
+		if err := subject.Fulfill(&o); err != nil {
+			t.Fatal(err)
+		}
+
+		var purchases []string
+		for _, p := range coinbase.Purchases {
+			purchases = append(purchases, p.Size.Ether())
+		}
+		if fmt.Sprint(purchases) != fmt.Sprint(test.purchases) {
+			t.Errorf("order of %d with %s: bought %v, expected %v", test.amount, test.balance, purchases, test.purchases)
+		}
+
+		if monzo.Pots["coinbase"] != -coinbase.BalancePence || monzo.Pots["float"] != o.LegAmount()-o.Commission-monzo.Pots["coinbase"] {
+			t.Errorf("order of %d with %s: pots %v", test.amount, test.balance, monzo.Pots)
+		}
+	}
+}
+
+func newTestLogic(t *testing.T, coinbase *MockCoinbase, monzo *MockMonzo) (*Logic, func()) {
+	dir, err := ioutil.TempDir("", "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject := &Logic{
+		coinbase:     coinbase,
+		monzo:        monzo,
+		etherBalance: coinbase.BalanceEth,
+		ledger:       &Ledger{dir: dir + "/"},
+	}
+	return subject, func() { os.RemoveAll(dir) }
+}
+
+func TestFulfillMakesUpPartialFills(t *testing.T) {
+	monzo := MockMonzo{Pots: make(map[string]int)}
+	coinbase := MockCoinbase{
+		EthAccounts:  make(map[string]Wei),
+		EtherPrice:   100,
+		PartialFills: 1,
+		FeePence:     3,
+	}
+	subject, cleanup := newTestLogic(t, &coinbase, &monzo)
+	defer cleanup()
+
+	o := newTestOrder("tx_partial")
+	o.State = OrderValidated
+
+	if err := subject.Fulfill(&o); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := subject.ledger.Load(o.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.Purchases) != 2 || saved.Purchases[0].DoneReason != "canceled" || saved.Purchases[1].DoneReason != "filled" {
+		t.Fatalf("purchases %+v", saved.Purchases)
 	}
 
-	if math.Abs(coinbase.BalanceEth-expectedEthBalance) > 0.00001 {
-		t.Error("coinbase ether balance")
+	// The fees on both purchases come out of the float
+	cost := 0
+	for _, p := range saved.Purchases {
+		if p.FeesPence != 3 {
+			t.Errorf("fees %d", p.FeesPence)
+		}
+		cost += p.CostPence()
+	}
+	if monzo.Pots["coinbase"] != cost || monzo.Pots["float"] != o.LegAmount()-o.Commission-cost {
+		t.Errorf("pots %v, cost %d", monzo.Pots, cost)
 	}
 
-	if math.Abs(coinbase.EthAccounts["0x52Ec249dD2eEc428b1E2f389c7d032caF5D1a238"]-expectedCustomerEthBalance) > 0.00001 {
+	if coinbase.EthAccounts[o.EthAddress.String()].Cmp(o.EtherAmount) != 0 {
 		t.Error("customer eth balance")
 	}
 }
+
+func TestFulfillWaitsForUnfinishedPurchase(t *testing.T) {
+	monzo := MockMonzo{Pots: make(map[string]int)}
+	coinbase := MockCoinbase{
+		EthAccounts: make(map[string]Wei),
+		EtherPrice:  100,
+		SlowFills:   1,
+	}
+	subject, cleanup := newTestLogic(t, &coinbase, &monzo)
+	defer cleanup()
+
+	o := newTestOrder("tx_slowfill")
+	o.State = OrderValidated
+
+	err := subject.Fulfill(&o)
+	if !IsTransient(err) {
+		t.Fatalf("expected transient error, got %v", err)
+	}
+
+	// Nothing is counted until the purchase finishes
+	o, err = subject.ledger.Load(o.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.State != OrderPriced || len(o.Purchases) != 1 || o.Purchases[0].Done() {
+		t.Fatalf("state %s, purchases %+v", o.State, o.Purchases)
+	}
+	if subject.EtherBalance().Sign() != 0 || monzo.Pots["coinbase"] != 0 {
+		t.Fatalf("balance %s, pots %v", subject.EtherBalance().Ether(), monzo.Pots)
+	}
+
+	if err := subject.Fulfill(&o); err != nil {
+		t.Fatal(err)
+	}
+
+	// The unfinished purchase was waited for rather than placed again
+	if len(coinbase.Purchases) != 1 || len(o.Purchases) != 1 || !o.Purchases[0].Done() {
+		t.Errorf("placed %d, recorded %+v", len(coinbase.Purchases), o.Purchases)
+	}
+	if monzo.Pots["coinbase"] != o.Purchases[0].CostPence() {
+		t.Errorf("pots %v", monzo.Pots)
+	}
+	if o.State != OrderBooksBalanced {
+		t.Errorf("state %s", o.State)
+	}
+}
+
+func TestPriceRoundsEtherToCoinbaseSize(t *testing.T) {
+	monzo := MockMonzo{Pots: make(map[string]int)}
+	coinbase := MockCoinbase{EthAccounts: make(map[string]Wei), EtherPrice: 300}
+	subject, cleanup := newTestLogic(t, &coinbase, &monzo)
+	defer cleanup()
+
+	_, fees, etherAmount, err := subject.Price(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exact, _ := EtherForPence(1000-fees.TotalPence, 300)
+	if etherAmount.Sign() <= 0 || etherAmount.Cmp(exact) >= 0 || etherAmount.RoundDown(CoinbaseSizeDecimals).Cmp(etherAmount) != 0 {
+		t.Errorf("ether amount %s, exact %s", etherAmount.Ether(), exact.Ether())
+	}
+
+	// Rounding takes less than the smallest amount Coinbase sends
+	if exact.Sub(etherAmount).Cmp(NewWei(10000000000)) >= 0 {
+		t.Errorf("rounded off %s wei", exact.Sub(etherAmount))
+	}
+
+	// and what it takes is noted on the order
+	o := newTestOrder("tx_rounded")
+	o.State = OrderValidated
+	if err := subject.Fulfill(&o); err != nil {
+		t.Fatal(err)
+	}
+	if o.EtherRoundedOff.Sign() <= 0 || o.EtherAmount.Add(o.EtherRoundedOff).Cmp(exact) != 0 {
+		t.Errorf("rounded off %s of %s, exact %s", o.EtherRoundedOff, o.EtherAmount, exact)
+	}
+}
+
+func TestFailedWithdrawalIsNotCountedTwice(t *testing.T) {
+	monzo := MockMonzo{Pots: make(map[string]int)}
+	coinbase := MockCoinbase{
+		EthAccounts:       make(map[string]Wei),
+		EtherPrice:        100,
+		BalanceEth:        NewWei(1000000000000000000),
+		FailedWithdrawals: 1,
+	}
+	subject, cleanup := newTestLogic(t, &coinbase, &monzo)
+	defer cleanup()
+
+	o := newTestOrder("tx_failedsync")
+	o.State = OrderInventoryBought
+	o.EtherAmount = NewWei(100000000000000000)
+
+	withdrawalId, err := coinbase.SendEther(o.EtherAmount, o.EthAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.WithdrawalId = withdrawalId
+	o.State = OrderEtherSending
+
+	// Coinbase gives the Ether back and a sync counts it before we hear of the failure
+	coinbase.GetWithdrawal(withdrawalId)
+	subject.etherBalance = coinbase.BalanceEth
+
+	if err := subject.Fulfill(&o); !IsTransient(err) {
+		t.Fatalf("expected transient error, got %v", err)
+	}
+	if o.State != OrderInventoryBought || subject.EtherBalance().Cmp(coinbase.BalanceEth) != 0 {
+		t.Errorf("state %s, balance %s, coinbase %s", o.State, subject.EtherBalance().Ether(), coinbase.BalanceEth.Ether())
+	}
+}
+
+func TestFulfillRefusesZeroAddress(t *testing.T) {
+	monzo := MockMonzo{Pots: make(map[string]int)}
+	coinbase := MockCoinbase{EthAccounts: make(map[string]Wei), EtherPrice: 100}
+	subject, cleanup := newTestLogic(t, &coinbase, &monzo)
+	defer cleanup()
+
+	o := newTestOrder("tx_zeroaddress")
+	o.EthAddress = eth.Address{}
+	o.State = OrderValidated
+
+	if err := subject.Fulfill(&o); KindOf(err) != KindUpstreamPermanent {
+		t.Errorf("expected permanent error, got %v", err)
+	}
+	if len(coinbase.Purchases) != 0 || len(coinbase.withdrawals) != 0 {
+		t.Error("traded for an order with no address")
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pause records who stopped trading and why
+type Pause struct {
+	Operator string
+	Reason   string
+	Time     time.Time
+}
+
+// Maintenance is the operator's switch for stopping trading without stopping
+// the process, so webhooks are still accepted while it is paused. The pause is
+// kept in a file so that it survives restarts and can be set from the command
+// line while the server is running.
+type Maintenance struct {
+	file string
+}
+
+// Paused returns the current pause, or nil if trading is allowed. A pause file
+// that cannot be read still pauses trading.
+func (m *Maintenance) Paused() *Pause {
+	dat, err := ioutil.ReadFile(m.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return &Pause{Reason: "Failed to read " + m.file + ": " + err.Error()}
+	}
+
+	p := &Pause{}
+	err = json.Unmarshal(dat, p)
+	if err != nil {
+		return &Pause{Reason: "Failed to parse " + m.file + ": " + err.Error()}
+	}
+	return p
+}
+
+// Pause stops trading until Resume is called
+func (m *Maintenance) Pause(operator string, reason string, now time.Time) error {
+	err := WriteJSONFile(m.file, Pause{Operator: operator, Reason: reason, Time: now.UTC()})
+	if err != nil {
+		return errors.New("Failed to pause trading: " + err.Error())
+	}
+
+	log.Printf("Operator %s paused trading: %s", operator, reason)
+	return nil
+}
+
+// Resume lets trading start again
+func (m *Maintenance) Resume(operator string) error {
+	err := os.Remove(m.file)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("Failed to resume trading: " + err.Error())
+	}
+
+	log.Printf("Operator %s resumed trading", operator)
+	return nil
+}
+
+// CheckMaintenance drains the backlog if trading has been resumed since it was
+// last called
+func (q *Queue) CheckMaintenance() {
+	paused := q.logic.maintenance != nil && q.logic.maintenance.Paused() != nil
+
+	q.mu.Lock()
+	resumed := q.paused && !paused
+	q.paused = paused
+	q.mu.Unlock()
+
+	if resumed {
+		go q.Drain()
+	}
+}
+
+// checkMaintenancePeriodically notices a pause being lifted from the command
+// line
+func (q *Queue) checkMaintenancePeriodically() {
+	for q.sleep(q.maintenanceCheck) {
+		q.CheckMaintenance()
+	}
+}
+
+// Drain works through every unfinished order one at a time, in the order the
+// payments were received. Orders pushed in the meantime, and orders from the
+// backlog that have to be retried, wait until the backlog has been worked
+// through.
+func (q *Queue) Drain() {
+	q.drainMu.Lock()
+	defer q.drainMu.Unlock()
+
+	q.mu.Lock()
+	q.draining = true
+	q.mu.Unlock()
+	defer q.endDrain()
+
+	orders, err := q.ledger.List()
+	if err != nil {
+		HandleError(errors.New("Failed to drain orders: " + err.Error()))
+		return
+	}
+
+	sort.SliceStable(orders, func(i, j int) bool {
+		return receivedTime(orders[i]).Before(receivedTime(orders[j]))
+	})
+
+	for _, o := range orders {
+		if o.IsFinished() {
+			continue
+		}
+
+		log.Printf("Draining order %s from state '%s'", o.Id, o.State)
+
+		done := make(chan struct{})
+		q.outstanding.Add(1)
+		q.setQueued(o.Id, 1)
+		q.push(queueJob{orderId: o.Id, done: done})
+		<-done
+	}
+}
+
+// endDrain queues the jobs that were held back while draining
+func (q *Queue) endDrain() {
+	q.mu.Lock()
+	q.draining = false
+	deferred := q.deferred
+	q.deferred = nil
+	q.mu.Unlock()
+
+	for _, job := range deferred {
+		q.push(job)
+	}
+}
+
+func receivedTime(o Order) time.Time {
+	if len(o.Transitions) == 0 {
+		return time.Time{}
+	}
+	return o.Transitions[0].Time
+}
+
+// PauseCommand pauses or resumes trading from the command line. Usage:
+//
+//	etherdirect pause [-operator name] reason...
+//	etherdirect resume [-operator name]
+//
+// A running server notices within MaintenanceCheckInterval.
+func PauseCommand(command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	operator := flags.String("operator", "", "Who is pausing or resuming trading. Defaults to the current user")
+	flags.Parse(args)
+
+	if *operator == "" {
+		u, err := user.Current()
+		if err != nil {
+			return errors.New("Failed to get current user, use -operator: " + err.Error())
+		}
+		*operator = u.Username
+	}
+
+	if command == "resume" {
+		return maintenance.Resume(*operator)
+	}
+
+	reason := strings.Join(flags.Args(), " ")
+	if reason == "" {
+		return errors.New("A reason is required to pause trading")
+	}
+	return maintenance.Pause(*operator, reason, time.Now())
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMaintenance(t *testing.T) (*Maintenance, func()) {
+	dir, err := ioutil.TempDir("", "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Maintenance{file: dir + "/paused.json"}, func() { os.RemoveAll(dir) }
+}
+
+func TestMaintenancePauseAndResume(t *testing.T) {
+	subject, cleanup := newTestMaintenance(t)
+	defer cleanup()
+
+	if subject.Paused() != nil {
+		t.Fatal("paused before pausing")
+	}
+
+	if err := subject.Pause("alice", "exchange upgrade", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process sees the same pause
+	other := &Maintenance{file: subject.file}
+	p := other.Paused()
+	if p == nil || p.Operator != "alice" || p.Reason != "exchange upgrade" {
+		t.Fatalf("pause %+v", p)
+	}
+
+	if err := other.Resume("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if subject.Paused() != nil {
+		t.Error("still paused after resuming")
+	}
+}
+
+func TestMaintenanceUnreadableFilePauses(t *testing.T) {
+	subject, cleanup := newTestMaintenance(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(subject.file, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if subject.Paused() == nil {
+		t.Error("corrupt pause file did not pause trading")
+	}
+}
+
+func TestQueueDefersOrdersWhilePaused(t *testing.T) {
+	subject, monzo, coinbase, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	m, cleanupMaintenance := newTestMaintenance(t)
+	defer cleanupMaintenance()
+	subject.logic.maintenance = m
+
+	if err := m.Pause("alice", "exchange upgrade", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Webhooks are still accepted while paused
+	var ids []string
+	for i := 0; i < 3; i++ {
+		order := newTestOrder(fmt.Sprintf("tx_paused%d", i))
+		monzo.SetTransaction(order.Transaction)
+		if err := subject.ledger.Receive(&order); err != nil {
+			t.Fatal(err)
+		}
+		subject.Push(order.Id)
+		ids = append(ids, order.Id)
+		time.Sleep(time.Millisecond)
+	}
+	subject.Wait()
+
+	for _, id := range ids {
+		waitForState(t, subject.ledger, id, OrderValidated)
+	}
+	if len(coinbase.EthAccounts) != 0 {
+		t.Fatal("sent Ether while paused")
+	}
+
+	if _, err := subject.logic.Quote("code", 1000, time.Now()); KindOf(err) != KindPaused {
+		t.Errorf("quoted while paused: %v", err)
+	}
+
+	handler := Operators{"alice": "secret"}.Require(MaintenanceHandler(subject, m))
+	r := httptest.NewRequest("POST", "/admin/maintenance", strings.NewReader(url.Values{"action": {"resume"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("alice", "secret")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("resume: %d", w.Code)
+	}
+
+	// The backlog is fulfilled in the order the payments arrived
+	var last time.Time
+	for _, id := range ids {
+		o := waitForState(t, subject.ledger, id, OrderBooksBalanced)
+		fulfilled := o.Transitions[len(o.Transitions)-1].Time
+		if fulfilled.Before(last) {
+			t.Errorf("order %s fulfilled out of order", id)
+		}
+		last = fulfilled
+	}
+}
+
+func TestDrainHoldsBackNewWork(t *testing.T) {
+	subject, monzo, coinbase, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	m, cleanupMaintenance := newTestMaintenance(t)
+	defer cleanupMaintenance()
+	subject.logic.maintenance = m
+	subject.backoff = 200 * time.Millisecond
+	subject.maxBackoff = 200 * time.Millisecond
+	coinbase.Delay = 10 * time.Millisecond
+
+	if err := m.Pause("alice", "exchange upgrade", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func(id string) {
+		order := newTestOrder(id)
+		monzo.SetTransaction(order.Transaction)
+		if err := subject.ledger.Receive(&order); err != nil {
+			t.Fatal(err)
+		}
+		subject.Push(order.Id)
+	}
+
+	receive("tx_backlog0")
+	time.Sleep(time.Millisecond)
+	receive("tx_backlog1")
+	subject.Wait()
+
+	// The first order in the backlog has to be retried
+	coinbase.PriceFailures = 1
+	if err := m.Resume("alice"); err != nil {
+		t.Fatal(err)
+	}
+	go subject.Drain()
+
+	for draining := false; !draining; time.Sleep(time.Millisecond) {
+		subject.mu.Lock()
+		draining = subject.draining
+		subject.mu.Unlock()
+	}
+	receive("tx_new")
+
+	finished := func(id string) time.Time {
+		o := waitForState(t, subject.ledger, id, OrderBooksBalanced)
+		return o.Transitions[len(o.Transitions)-1].Time
+	}
+	retried := finished("tx_backlog0")
+	backlog := finished("tx_backlog1")
+	fresh := finished("tx_new")
+
+	if !backlog.Before(retried) {
+		t.Error("drain waited for a retrying order")
+	}
+	if !backlog.Before(fresh) {
+		t.Error("new order jumped ahead of the backlog")
+	}
+}
+
+func TestQueueRefundsOrdersWhilePaused(t *testing.T) {
+	subject, monzo, _, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	m, cleanupMaintenance := newTestMaintenance(t)
+	defer cleanupMaintenance()
+	subject.logic.maintenance = m
+	subject.policy = &ErrorPolicy{RefundWhenPaused: true}
+
+	if err := m.Pause("alice", "exchange upgrade", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	order := newTestOrder("tx_pausedrefund")
+	monzo.SetTransaction(order.Transaction)
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(order.Id)
+	subject.Wait()
+
+	o := waitForState(t, subject.ledger, order.Id, OrderRefunded)
+	if o.ErrorKind != KindPaused || monzo.Pots["refund"] != 1000 {
+		t.Errorf("kind %s, pots %v", o.ErrorKind, monzo.Pots)
+	}
+}
+
+func TestIndexShowsMaintenanceBanner(t *testing.T) {
+	for _, paused := range []bool{false, true} {
+		var b bytes.Buffer
+		if err := templates["index"].Execute(&b, IndexViewModel{Paused: paused}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(b.String(), "down for maintenance") != paused {
+			t.Errorf("paused %t: banner shown %t", paused, !paused)
+		}
+	}
+}
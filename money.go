@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+const WeiPerEther = 1000000000000000000
+
+var weiPerEther = big.NewInt(WeiPerEther)
+
+// Wei is an exact amount of Ether in its smallest unit. Wei values are never
+// modified, arithmetic returns a new value. The zero value is zero.
+type Wei struct {
+	v *big.Int
+}
+
+func NewWei(v int64) Wei {
+	return Wei{v: big.NewInt(v)}
+}
+
+func (w Wei) Int() *big.Int {
+	if w.v == nil {
+		return new(big.Int)
+	}
+	return new(big.Int).Set(w.v)
+}
+
+func (w Wei) Add(x Wei) Wei {
+	return Wei{v: new(big.Int).Add(w.Int(), x.Int())}
+}
+
+func (w Wei) Sub(x Wei) Wei {
+	return Wei{v: new(big.Int).Sub(w.Int(), x.Int())}
+}
+
+func (w Wei) Cmp(x Wei) int {
+	return w.Int().Cmp(x.Int())
+}
+
+func (w Wei) Sign() int {
+	return w.Int().Sign()
+}
+
+func (w Wei) String() string {
+	return w.Int().String()
+}
+
+// Ether formats the amount in Ether with as many decimal places as it needs,
+// such as "0.085"
+func (w Wei) Ether() string {
+	i := w.Int()
+	sign := ""
+	if i.Sign() < 0 {
+		sign = "-"
+		i.Neg(i)
+	}
+
+	whole, frac := new(big.Int).QuoRem(i, weiPerEther, new(big.Int))
+	if frac.Sign() == 0 {
+		return sign + whole.String()
+	}
+
+	digits := frac.String()
+	digits = strings.Repeat("0", 18-len(digits)) + digits
+	return sign + whole.String() + "." + strings.TrimRight(digits, "0")
+}
+
+// ParseEther reads an amount of Ether such as "0.085" exactly. Amounts with
+// more than 18 decimal places are an error.
+func ParseEther(s string) (Wei, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return Wei{}, errors.New("Invalid Ether amount: " + s)
+	}
+
+	r.Mul(r, new(big.Rat).SetInt(weiPerEther))
+	if !r.IsInt() {
+		return Wei{}, errors.New("Ether amount is more precise than 1 wei: " + s)
+	}
+	return Wei{v: new(big.Int).Set(r.Num())}, nil
+}
+
+// EtherForPence works out how much Ether the given amount of money buys at a
+// price in GBP per Ether. The result is rounded down to the wei, so it is
+// never more than the money buys and at most 1 wei less. Orders are then
+// rounded down further to what Coinbase sends, see Logic.Price.
+func EtherForPence(pence int, priceGbp float64) (Wei, error) {
+	if priceGbp <= 0 {
+		return Wei{}, errors.New("Ether price must be more than zero")
+	}
+
+	price := new(big.Rat).SetFloat64(priceGbp)
+	if price == nil {
+		return Wei{}, errors.New("Invalid Ether price")
+	}
+
+	// wei = pence / 100 / price * wei per ether
+	r := new(big.Rat).SetInt64(int64(pence))
+	r.Mul(r, new(big.Rat).SetInt(weiPerEther))
+	r.Quo(r, new(big.Rat).SetInt64(100))
+	r.Quo(r, price)
+
+	return Wei{v: new(big.Int).Quo(r.Num(), r.Denom())}, nil
+}
+
+// MarshalJSON writes the amount as a string of wei so that it is exact
+func (w Wei) MarshalJSON() ([]byte, error) {
+	return json.Marshal(w.String())
+}
+
+// UnmarshalJSON reads a string of wei, or a number of Ether as written by
+// versions that used floating point. Numbers are rounded down to the wei.
+func (w *Wei) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*w = Wei{}
+		return nil
+	}
+
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		i, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return errors.New("Invalid wei amount: " + s)
+		}
+		*w = Wei{v: i}
+		return nil
+	}
+
+	r, ok := new(big.Rat).SetString(string(data))
+	if !ok {
+		return errors.New("Invalid Ether amount: " + string(data))
+	}
+	r.Mul(r, new(big.Rat).SetInt(weiPerEther))
+	*w = Wei{v: new(big.Int).Quo(r.Num(), r.Denom())}
+	return nil
+}
+
+// PenceForEther works out what an amount of Ether costs at a price in GBP per
+// Ether, rounded up to the penny
+func PenceForEther(w Wei, priceGbp float64) int {
+	r := new(big.Rat).SetInt(w.Int())
+	r.Mul(r, new(big.Rat).SetFloat64(priceGbp))
+	r.Mul(r, new(big.Rat).SetInt64(100))
+	r.Quo(r, new(big.Rat).SetInt(weiPerEther))
+	return int(ratCeil(r).Int64())
+}
+
+// ParsePence reads an amount of GBP such as "12.3456" rounded up to the penny
+func ParsePence(s string) (int, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, errors.New("Invalid GBP amount: " + s)
+	}
+	r.Mul(r, new(big.Rat).SetInt64(100))
+	return int(ratCeil(r).Int64()), nil
+}
+
+// RoundUp rounds the amount up to the given number of decimal places of Ether
+func (w Wei) RoundUp(decimals int) Wei {
+	unit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(18-decimals)), nil)
+	r := new(big.Rat).SetFrac(w.Int(), unit)
+	return Wei{v: new(big.Int).Mul(ratCeil(r), unit)}
+}
+
+// RoundDown rounds the amount down to the given number of decimal places of Ether
+func (w Wei) RoundDown(decimals int) Wei {
+	unit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(18-decimals)), nil)
+	q := new(big.Int).Quo(w.Int(), unit)
+	return Wei{v: q.Mul(q, unit)}
+}
+
+func ratCeil(r *big.Rat) *big.Int {
+	q, m := new(big.Int).DivMod(r.Num(), r.Denom(), new(big.Int))
+	if m.Sign() != 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	return q
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEtherForPenceRoundsInHouseFavour(t *testing.T) {
+	tests := []struct {
+		pence    int
+		price    float64
+		expected string
+	}{
+		{850, 100, "85000000000000000"},
+		// a third of an Ether is rounded down to the wei
+		{100, 3, "333333333333333333"},
+		{200, 3, "666666666666666666"},
+		{1, 1234.56, "8100051840331"},
+	}
+
+	for _, test := range tests {
+		actual, err := EtherForPence(test.pence, test.price)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual.String() != test.expected {
+			t.Errorf("%d at %f: %s, expected %s", test.pence, test.price, actual, test.expected)
+		}
+	}
+
+	if _, err := EtherForPence(100, 0); err == nil {
+		t.Error("priced at zero")
+	}
+}
+
+func TestEtherParsingAndFormatting(t *testing.T) {
+	for _, s := range []string{"0", "1", "0.085", "12.000000000000000001", "-0.5"} {
+		w, err := ParseEther(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Ether() != s {
+			t.Errorf("%s formatted as %s", s, w.Ether())
+		}
+	}
+
+	if _, err := ParseEther("0.0000000000000000001"); err == nil {
+		t.Error("parsed less than a wei")
+	}
+	if _, err := ParseEther("abc"); err == nil {
+		t.Error("parsed nonsense")
+	}
+}
+
+func TestWeiJSON(t *testing.T) {
+	w, _ := ParseEther("0.085")
+
+	dat, err := json.Marshal(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dat) != `"85000000000000000"` {
+		t.Errorf("marshalled as %s", dat)
+	}
+
+	var actual Wei
+	if err := json.Unmarshal(dat, &actual); err != nil || actual.Cmp(w) != 0 {
+		t.Errorf("unmarshalled as %s: %v", actual, err)
+	}
+
+	// Orders recorded before amounts were exact hold a number of Ether
+	if err := json.Unmarshal([]byte("0.085"), &actual); err != nil || actual.Cmp(w) != 0 {
+		t.Errorf("legacy unmarshalled as %s: %v", actual, err)
+	}
+
+	var zero Wei
+	if zero.Sign() != 0 || zero.Add(w).Cmp(w) != 0 || w.Sub(w).Sign() != 0 {
+		t.Error("zero value")
+	}
+}
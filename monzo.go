@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	monzo "github.com/tjvr/go-monzo"
@@ -17,6 +18,8 @@ import (
 
 type IMonzo interface {
 	MoveToPot(potName string, amountPence int) error
+	GetTransaction(id string) (MonzoWebHookTransaction, error)
+	PostInfo(heading string, msg string) error
 }
 
 type MonzoWebHookCounterParty struct {
@@ -26,11 +29,25 @@ type MonzoWebHookCounterParty struct {
 }
 
 type MonzoWebHookTransaction struct {
-	AccountId    string `json:"account_id"`
-	Description  string
-	Amount       int
-	Currency     string
-	CounterParty MonzoWebHookCounterParty
+	Id            string
+	AccountId     string `json:"account_id"`
+	Description   string
+	Amount        int
+	Currency      string
+	CounterParty  MonzoWebHookCounterParty
+	Settled       string
+	DeclineReason string `json:"decline_reason"`
+	Metadata      map[string]string
+}
+
+// IsSettled reports whether the payment has settled. Monzo sets the settled
+// time in advance for faster payments, so it only counts once it has passed.
+func (t MonzoWebHookTransaction) IsSettled(now time.Time) bool {
+	settled, err := time.Parse(time.RFC3339, t.Settled)
+	if err != nil {
+		return false
+	}
+	return !settled.After(now)
 }
 
 type MonzoWebHook struct {
@@ -108,7 +125,7 @@ func (m *Monzo) RefreshAccessToken() {
 }
 
 func (m *Monzo) GetAccessToken(params url.Values) {
-	rsp, err := http.PostForm("https://api.monzo.com/oauth2/token", params)
+	rsp, err := http.PostForm(MonzoApiRoot+"oauth2/token", params)
 
 	if err != nil {
 		panic(err.Error())
@@ -124,25 +141,23 @@ func (m *Monzo) GetAccessToken(params url.Values) {
 	m.client = monzo.Client{
 		AccessToken:  data.AccessToken,
 		RefreshToken: data.RefreshToken,
-		BaseURL:      "https://api.monzo.com/",
+		BaseURL:      MonzoApiRoot,
 		UserID:       os.Getenv("MonzoUserId"),
 	}
+	m.isLoggedIn = true
 
 	log.Printf("Successfully logged into Monzo. Access token: %s Refresh Token: %s", m.client.AccessToken, m.client.RefreshToken)
 }
 
-func (m *Monzo) PostError(err error) error {
-	if !m.isLoggedIn {
-		return errors.New("Not logged in to monzo")
+// UseAccessToken logs in with an access token obtained elsewhere, for command
+// line tools that cannot go through the OAuth flow
+func (m *Monzo) UseAccessToken(token string) {
+	m.client = monzo.Client{
+		AccessToken: token,
+		BaseURL:     MonzoApiRoot,
+		UserID:      os.Getenv("MonzoUserId"),
 	}
-
-	return m.client.CreateFeedItem(&monzo.FeedItem{
-		AccountID: os.Getenv("MonzoAccountId"),
-		Title:     "ERROR",
-		Body:      err.Error(),
-		Type:      "basic",
-		ImageURL:  "https://cdn0.iconfinder.com/data/icons/elasto-online-store/26/00-ELASTOFONT-STORE-READY_close-512.png",
-	})
+	m.isLoggedIn = true
 }
 
 func (m *Monzo) PostInfo(heading string, msg string) error {
@@ -162,8 +177,9 @@ func (m *Monzo) PostInfo(heading string, msg string) error {
 func (m *Monzo) MoveToPot(potName string, amountPence int) error {
 	potId := m.getPotId(potName)
 
-	ddid := m.nextDedupeId
-	m.nextDedupeId = m.nextDedupeId + 1
+	// Several orders move money at once, and Monzo drops a deposit that reuses
+	// a dedupe ID
+	ddid := atomic.AddInt64(&m.nextDedupeId, 1) - 1
 
 	_, err := m.client.Deposit(&monzo.DepositRequest{
 		PotID:          potId,
@@ -185,6 +201,47 @@ func (m *Monzo) MoveToPot(potName string, amountPence int) error {
 	return nil
 }
 
+// GetTransaction fetches a transaction from the Monzo API. Failures that may
+// succeed later are returned as transient errors.
+func (m *Monzo) GetTransaction(id string) (tx MonzoWebHookTransaction, err error) {
+	if !m.isLoggedIn {
+		return tx, Transient(errors.New("Not logged in to monzo"))
+	}
+
+	req, err := http.NewRequest("GET", m.client.BaseURL+"transactions/"+url.PathEscape(id), nil)
+	if err != nil {
+		return tx, err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.client.AccessToken)
+
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return tx, Transient(errors.New("Failed to fetch Monzo transaction " + id + ": " + err.Error()))
+	}
+	defer rsp.Body.Close()
+
+	switch {
+	case rsp.StatusCode == http.StatusOK:
+	case rsp.StatusCode == http.StatusNotFound:
+		return tx, Permanent(errors.New("Monzo transaction " + id + " does not exist"))
+	case rsp.StatusCode == http.StatusUnauthorized || rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode >= 500:
+		return tx, Transient(errors.New("Failed to fetch Monzo transaction " + id + ": " + rsp.Status))
+	default:
+		return tx, Permanent(errors.New("Failed to fetch Monzo transaction " + id + ": " + rsp.Status))
+	}
+
+	data := struct {
+		Transaction MonzoWebHookTransaction
+	}{}
+	decoder := json.NewDecoder(rsp.Body)
+	err = decoder.Decode(&data)
+	if err != nil {
+		return tx, Permanent(errors.New("Failed to parse Monzo transaction " + id + ": " + err.Error()))
+	}
+
+	return data.Transaction, nil
+}
+
 func (m *Monzo) GetBalance(potName string) (int64, error) {
 	potId := m.getPotId(potName)
 	p, e := m.client.Pot(potId)
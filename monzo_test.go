@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	monzo "github.com/tjvr/go-monzo"
+)
+
+func newFakeMonzo(tx MonzoWebHookTransaction) (*Monzo, *httptest.Server) {
+	api := &FakeMonzoApi{AccessToken: "token"}
+	api.AddTransaction(tx)
+
+	server := httptest.NewServer(api)
+
+	return &Monzo{
+		client: monzo.Client{
+			BaseURL:     server.URL + "/",
+			AccessToken: "token",
+		},
+		isLoggedIn: true,
+	}, server
+}
+
+func TestVerifyOrder(t *testing.T) {
+	tx := MonzoWebHookTransaction{
+		Id:          "tx_00009exl5Ni96JK2NMC9c9",
+		AccountId:   "acc_123",
+		Description: "1549210000",
+		Amount:      1000,
+		Currency:    "GBP",
+		CounterParty: MonzoWebHookCounterParty{
+			Name:          "Name",
+			SortCode:      "000000",
+			AccountNumber: "00000000",
+		},
+	}
+
+	m, server := newFakeMonzo(tx)
+	defer server.Close()
+
+	if _, err := VerifyOrder(&Order{Transaction: tx}, m); err != nil {
+		t.Errorf("genuine webhook rejected: %s", err.Error())
+	}
+
+	forged := tx
+	forged.Amount = 5000
+	if _, err := VerifyOrder(&Order{Transaction: forged}, m); err == nil || IsTransient(err) {
+		t.Errorf("forged amount accepted: %v", err)
+	}
+
+	forged = tx
+	forged.CounterParty.AccountNumber = "11111111"
+	if _, err := VerifyOrder(&Order{Transaction: forged}, m); err == nil || IsTransient(err) {
+		t.Errorf("forged counterparty accepted: %v", err)
+	}
+
+	forged = tx
+	forged.Id = "tx_doesnotexist"
+	if _, err := VerifyOrder(&Order{Transaction: forged}, m); err == nil || IsTransient(err) {
+		t.Errorf("unknown transaction accepted: %v", err)
+	}
+}
+
+func TestGetTransactionUnauthorizedIsTransient(t *testing.T) {
+	m, server := newFakeMonzo(MonzoWebHookTransaction{Id: "tx_1"})
+	defer server.Close()
+
+	m.client.AccessToken = "expired"
+
+	_, err := m.GetTransaction("tx_1")
+	if !IsTransient(err) {
+		t.Errorf("expected transient error, got %v", err)
+	}
+}
+
+func TestMoveToPotUsesUniqueDedupeIds(t *testing.T) {
+	m, server := newFakeMonzo(MonzoWebHookTransaction{})
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.MoveToPot("float", 1)
+		}()
+	}
+	wg.Wait()
+
+	if m.nextDedupeId != 20 {
+		t.Errorf("next dedupe ID %d after 20 deposits", m.nextDedupeId)
+	}
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrUnknownOrder = errors.New("Unknown order")
+
+type queueJob struct {
+	orderId string
+	attempt int
+
+	// Closed once the order has been dealt with, if not nil
+	done chan struct{}
+}
+
+// Queue fulfils or refunds orders in the background so that webhooks can be
+// acknowledged straight away. Orders are already on disk in the ledger before
+// they are pushed, so the queue only holds order IDs and anything left
+// unfinished when the process stops is picked up again by Start.
+type Queue struct {
+	ledger      *Ledger
+	logic       *Logic
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	jobs        chan queueJob
+
+	// Closed by Stop. running counts the workers that have not yet returned.
+	stop    chan struct{}
+	running sync.WaitGroup
+
+	// Only fulfil payments once they have settled
+	settledOnly bool
+
+	// How often to check whether payments awaiting settlement have settled
+	settlementCheck time.Duration
+
+	// How often to check on Ether withdrawals that have not finished, or zero
+	// not to
+	withdrawalCheck time.Duration
+
+	// How often to queue again any unfinished order that is not already
+	// queued, such as one given up on after maxAttempts, or zero not to
+	sweep time.Duration
+
+	// Optional limits on how much each customer can spend
+	limits *VelocityLimits
+
+	// Decides what to do about orders that fail
+	policy *ErrorPolicy
+
+	// Optional rules for which refunds an operator must approve
+	review *RefundReviewPolicy
+
+	// How often to sync the Ether inventory from Coinbase, or zero not to
+	inventorySync      time.Duration
+	inventoryTolerance Wei
+	inventorySynced    bool
+
+	// Optional band to keep the Ether inventory within, and how often to check
+	band      *InventoryBand
+	rebalance time.Duration
+
+	// How often to check whether trading has been resumed from the command
+	// line, or zero not to. paused is guarded by mu.
+	maintenanceCheck time.Duration
+	paused           bool
+
+	// Only one drain of the backlog at a time. While one is going on, other
+	// jobs wait in deferred so they cannot jump ahead of the backlog. draining
+	// and deferred are guarded by mu.
+	drainMu  sync.Mutex
+	draining bool
+	deferred []queueJob
+
+	// Only one order at a time may be checked against the velocity limits
+	velocity sync.Mutex
+
+	// Only one goroutine at a time may work on any given order. queued counts
+	// the jobs for each order that have not finished. Jobs pushed once stopped
+	// is set are dropped.
+	mu      sync.Mutex
+	locks   map[string]*orderLock
+	queued  map[string]int
+	stopped bool
+
+	// Jobs that have been pushed but not yet finished, including those waiting to retry
+	outstanding sync.WaitGroup
+}
+
+type orderLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (q *Queue) Start() error {
+	q.mu.Lock()
+	q.jobs = make(chan queueJob)
+	q.stop = make(chan struct{})
+	q.stopped = false
+	q.mu.Unlock()
+
+	// Know what we hold before resuming any orders, but carry on without it
+	// if Coinbase cannot be reached
+	if q.inventorySync > 0 {
+		HandleError(q.SyncInventory())
+		go q.syncInventoryPeriodically()
+	}
+
+	if q.band != nil && q.rebalance > 0 {
+		go q.rebalancePeriodically()
+	}
+
+	for i := 0; i < q.workers; i++ {
+		q.running.Add(1)
+		go q.work(q.jobs, q.stop)
+	}
+
+	q.CheckMaintenance()
+	if q.maintenanceCheck > 0 {
+		go q.checkMaintenancePeriodically()
+	}
+
+	err := q.Resume()
+	if err != nil {
+		return err
+	}
+
+	if q.settledOnly {
+		go q.checkSettlements()
+	}
+
+	if q.withdrawalCheck > 0 {
+		go q.checkWithdrawals()
+	}
+
+	if q.sweep > 0 {
+		go q.sweepPeriodically()
+	}
+
+	return nil
+}
+
+// Stop waits for the workers to finish the orders they are working on and
+// stops the background checks. Orders still queued are dropped and left in
+// the ledger for the next Start to resume.
+func (q *Queue) Stop() {
+	q.mu.Lock()
+	if q.stopped || q.stop == nil {
+		q.mu.Unlock()
+		return
+	}
+	q.stopped = true
+	close(q.stop)
+	q.mu.Unlock()
+
+	q.running.Wait()
+}
+
+// sleep waits for d, returning false if the queue is stopped first
+func (q *Queue) sleep(d time.Duration) bool {
+	select {
+	case <-q.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Resume queues every order that has not finished, such as orders left behind
+// by a previous run or waiting for trading to resume
+func (q *Queue) Resume() error {
+	orders, err := q.ledger.List()
+	if err != nil {
+		return err
+	}
+
+	for _, o := range orders {
+		if o.IsFinished() {
+			continue
+		}
+
+		log.Printf("Resuming order %s from state '%s'", o.Id, o.State)
+		q.Push(o.Id)
+	}
+
+	return nil
+}
+
+// Update applies a transaction.updated webhook to an existing order. Returns
+// ErrUnknownOrder if we have no order for the transaction.
+func (q *Queue) Update(tx MonzoWebHookTransaction) error {
+	if !IsValidTransactionId(tx.Id) {
+		return errors.New("Invalid transaction ID: " + tx.Id)
+	}
+
+	unlock := q.lock(tx.Id)
+	defer unlock()
+
+	o, err := q.ledger.Load(tx.Id)
+	if os.IsNotExist(err) {
+		return ErrUnknownOrder
+	}
+	if err != nil {
+		return errors.New("Failed to load order " + tx.Id + ": " + err.Error())
+	}
+
+	// An update can be forged just like a new transaction
+	actual, err := VerifyOrder(&Order{Transaction: tx}, q.logic.monzo)
+	if err != nil {
+		if IsTransient(err) {
+			return err
+		}
+		return Permanent(errors.New("Rejected update to order " + o.Id + ", possible forged webhook: " + err.Error()))
+	}
+
+	o.Transaction.Settled = actual.Settled
+	o.Transaction.DeclineReason = actual.DeclineReason
+	o.Transaction.Metadata = actual.Metadata
+
+	if actual.DeclineReason == "" {
+		err = q.ledger.Save(&o)
+		if err != nil {
+			return err
+		}
+
+		if o.State == OrderAwaitingSettlement {
+			q.Push(o.Id)
+		}
+		return nil
+	}
+
+	log.Printf("Payment for order %s declined or reversed: %s", o.Id, actual.DeclineReason)
+
+	err = q.reverse(&o, actual.DeclineReason)
+	if err != nil {
+		return err
+	}
+
+	if o.ExcessOrderId == "" {
+		return nil
+	}
+
+	unlockExcess := q.lock(o.ExcessOrderId)
+	defer unlockExcess()
+
+	excess, err := q.ledger.Load(o.ExcessOrderId)
+	if err != nil {
+		return errors.New("Failed to load order " + o.ExcessOrderId + ": " + err.Error())
+	}
+
+	return q.reverse(&excess, actual.DeclineReason)
+}
+
+// reverse cancels an order whose payment has been declined or reversed, or
+// raises an incident if it is too late to cancel it
+func (q *Queue) reverse(o *Order, reason string) error {
+	switch {
+	case o.CanTransition(OrderCancelled):
+		return q.ledger.Record(o, OrderCancelled)
+
+	case o.State == OrderEtherSending || o.State == OrderEtherSent || o.State == OrderBooksBalanced || o.State == OrderRefunded:
+		// We have already paid out for this payment
+		o.Incident = "Payment reversed after the order was " + string(o.State) + ": " + reason
+		err := q.ledger.Save(o)
+		RaiseIncident(errors.New("Order " + o.Id + ": " + o.Incident))
+		return err
+	}
+
+	return q.ledger.Save(o)
+}
+
+// lock stops any other goroutine working on the order until the returned
+// function is called
+func (q *Queue) lock(orderId string) func() {
+	q.mu.Lock()
+	if q.locks == nil {
+		q.locks = make(map[string]*orderLock)
+	}
+	l, ok := q.locks[orderId]
+	if !ok {
+		l = &orderLock{}
+		q.locks[orderId] = l
+	}
+	l.refs++
+	q.mu.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		q.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(q.locks, orderId)
+		}
+		q.mu.Unlock()
+	}
+}
+
+func (q *Queue) checkSettlements() {
+	for q.sleep(q.settlementCheck) {
+		orders, err := q.ledger.List()
+		if err != nil {
+			HandleError(errors.New("Failed to check for settled payments: " + err.Error()))
+			continue
+		}
+
+		for _, o := range orders {
+			if o.State == OrderAwaitingSettlement {
+				q.Push(o.Id)
+			}
+		}
+	}
+}
+
+func (q *Queue) checkWithdrawals() {
+	for q.sleep(q.withdrawalCheck) {
+		orders, err := q.ledger.List()
+		if err != nil {
+			HandleError(errors.New("Failed to check Ether withdrawals: " + err.Error()))
+			continue
+		}
+
+		for _, o := range orders {
+			if o.State == OrderEtherSending {
+				q.Push(o.Id)
+			}
+		}
+	}
+}
+
+// sweepPeriodically queues again the orders that could make progress but are
+// not queued, so an order given up on is not left until the next restart.
+// Orders waiting for an operator or for their payment to settle are left alone.
+func (q *Queue) sweepPeriodically() {
+	for q.sleep(q.sweep) {
+		orders, err := q.ledger.List()
+		if err != nil {
+			HandleError(errors.New("Failed to sweep unfinished orders: " + err.Error()))
+			continue
+		}
+
+		for _, o := range orders {
+			if o.IsFinished() || o.State == OrderHeld || o.State == OrderRefundReview || o.State == OrderAwaitingSettlement {
+				continue
+			}
+			if q.isQueued(o.Id) {
+				continue
+			}
+
+			log.Printf("Sweeping order %s from state '%s'", o.Id, o.State)
+			q.Push(o.Id)
+		}
+	}
+}
+
+// Push queues an order without blocking the caller
+func (q *Queue) Push(orderId string) {
+	q.outstanding.Add(1)
+	q.setQueued(orderId, 1)
+	q.push(queueJob{orderId: orderId})
+}
+
+func (q *Queue) isQueued(orderId string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.queued[orderId] > 0
+}
+
+func (q *Queue) setQueued(orderId string, delta int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.queued == nil {
+		q.queued = make(map[string]int)
+	}
+	q.queued[orderId] += delta
+	if q.queued[orderId] <= 0 {
+		delete(q.queued, orderId)
+	}
+}
+
+// Wait blocks until every order pushed so far has been dealt with
+func (q *Queue) Wait() {
+	q.outstanding.Wait()
+}
+
+func (q *Queue) push(job queueJob) {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		q.finish(job)
+		return
+	}
+	if q.draining && job.done == nil {
+		q.deferred = append(q.deferred, job)
+		q.mu.Unlock()
+		return
+	}
+	jobs, stop := q.jobs, q.stop
+	q.mu.Unlock()
+
+	go func() {
+		select {
+		case jobs <- job:
+		case <-stop:
+			q.finish(job)
+		}
+	}()
+}
+
+// finish marks a job as dealt with
+func (q *Queue) finish(job queueJob) {
+	if job.done != nil {
+		close(job.done)
+	}
+	q.setQueued(job.orderId, -1)
+	q.outstanding.Done()
+}
+
+func (q *Queue) work(jobs <-chan queueJob, stop <-chan struct{}) {
+	defer q.running.Done()
+
+	for {
+		var job queueJob
+		select {
+		case job = <-jobs:
+		case <-stop:
+			return
+		}
+
+		err := q.process(job.orderId)
+
+		if q.policy.Decide(err) == ActionRetry {
+			if job.attempt+1 < q.maxAttempts {
+				delay := q.backoffFor(job.attempt)
+				log.Printf("Order %s failed on attempt %d, retrying in %s: %s", job.orderId, job.attempt+1, delay, err.Error())
+				job.attempt++
+
+				// A drain moves on to the next order rather than waiting out the backoff
+				if job.done != nil {
+					close(job.done)
+					job.done = nil
+				}
+				retry := job
+				time.AfterFunc(delay, func() {
+					q.push(retry)
+				})
+				continue
+			}
+
+			// The order is left as it is and will be tried again by the next sweep
+			err = Permanent(fmt.Errorf("Gave up on order %s after %d attempts: %s", job.orderId, q.maxAttempts, err.Error()))
+		}
+
+		if q.policy.Decide(err) == ActionWait {
+			// The order will be pushed again when trading resumes
+			log.Printf("Order %s waiting: %s", job.orderId, err.Error())
+			err = nil
+		}
+
+		HandleError(err)
+		q.finish(job)
+	}
+}
+
+func (q *Queue) backoffFor(attempt int) time.Duration {
+	delay := q.backoff
+	for i := 0; i < attempt && delay < q.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.maxBackoff {
+		delay = q.maxBackoff
+	}
+	return delay
+}
+
+func (q *Queue) process(orderId string) error {
+	unlock := q.lock(orderId)
+	defer unlock()
+
+	o, err := q.ledger.Load(orderId)
+	if err != nil {
+		return errors.New("Failed to load order " + orderId + ": " + err.Error())
+	}
+
+	if o.State == OrderReceived || o.State == OrderAwaitingSettlement {
+		err = q.checkTransaction(&o)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch o.State {
+	case OrderRefundPending:
+		return q.refund(&o, o.Err())
+
+	case OrderValidated, OrderPriced, OrderInventoryBought, OrderEtherSending, OrderEtherSent:
+		err = q.logic.Fulfill(&o)
+		if err == nil {
+			return nil
+		}
+
+		// Ether may already have been sent, in which case the order can only be retried
+		next := q.stateForError(err)
+		if o.CanTransition(next) {
+			o.SetError(err)
+			if next == OrderRefundPending {
+				return q.refund(&o, err)
+			}
+			err2 := q.ledger.Record(&o, next)
+			if err2 != nil {
+				return err2
+			}
+			q.notifyHeld(&o)
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// refund pays the customer back. A payout the bank refuses will not succeed
+// by retrying, so the order is held for an operator to refund by hand.
+func (q *Queue) refund(o *Order, err error) error {
+	review, err2 := q.holdForReview(o, err)
+	if review {
+		if err2 != nil {
+			return err2
+		}
+		return err
+	}
+
+	err2 = q.logic.Refund(o, err)
+	if o.State != OrderRefundPending || KindOf(err2) != KindUpstreamPermanent {
+		return err2
+	}
+
+	o.Incident = err2.Error()
+	err3 := q.ledger.Record(o, OrderHeld)
+	if err3 != nil {
+		return errors.New("Failed to hold order: " + err3.Error() + ". Original error: " + err2.Error())
+	}
+
+	RaiseIncident(fmt.Errorf("Order %s held for review: %s", o.Id, err2.Error()))
+	return nil
+}
+
+// stateForError decides, according to the error policy, whether an order that
+// cannot be fulfilled should be refunded, held for an operator, or left where
+// it is to be retried
+func (q *Queue) stateForError(err error) OrderState {
+	switch q.policy.Decide(err) {
+	case ActionRefund:
+		return OrderRefundPending
+	case ActionHold, ActionPage:
+		return OrderHeld
+	}
+	return ""
+}
+
+func (q *Queue) notifyHeld(o *Order) {
+	msg := fmt.Sprintf("Order %s held for review: %s", o.Id, o.Error)
+	log.Println(msg)
+
+	if q.policy.Decide(o.Err()) == ActionPage {
+		RaiseIncident(errors.New(msg))
+		return
+	}
+	q.logic.monzo.PostInfo("HELD", msg)
+}
+
+// checkTransaction confirms the order's transaction with Monzo and decides
+// whether it should be fulfilled, refunded, cancelled or left to settle
+func (q *Queue) checkTransaction(o *Order) error {
+
+	// Never act on a webhook, even to refund it, until Monzo confirms it is real
+	actual, err := VerifyOrder(o, q.logic.monzo)
+	if IsTransient(err) {
+		return err
+	}
+	if err != nil {
+		o.SetError(err)
+		err2 := q.ledger.Record(o, OrderRejected)
+		if err2 != nil {
+			return errors.New("Failed to record rejected order: " + err2.Error() + ". Original error: " + err.Error())
+		}
+		return Permanent(errors.New("Rejected order " + o.Id + ", possible forged webhook: " + err.Error()))
+	}
+
+	o.Transaction.Settled = actual.Settled
+	o.Transaction.DeclineReason = actual.DeclineReason
+	o.Transaction.Metadata = actual.Metadata
+
+	var next OrderState
+	switch {
+	case actual.DeclineReason != "":
+		// The money never arrived, so there is nothing to fulfil or refund
+		next = OrderCancelled
+	case o.Error != "":
+		next = q.stateForError(o.Err())
+	case q.settledOnly && !actual.IsSettled(time.Now()):
+		if o.State == OrderAwaitingSettlement {
+			return q.ledger.Save(o)
+		}
+		next = OrderAwaitingSettlement
+	default:
+		next = OrderValidated
+	}
+
+	accepting := o.State == OrderReceived && (next == OrderValidated || next == OrderAwaitingSettlement)
+
+	// ParseOrder only lets through payments over the maximum if they are to be partially fulfilled
+	if accepting && o.ParentId == "" && o.Amount > MaxOrderPence {
+		o.Excess = o.Amount - MaxOrderPence
+	}
+
+	if accepting && q.limits != nil {
+
+		// Hold the lock until the order is saved so the next order is checked against it
+		q.velocity.Lock()
+		defer q.velocity.Unlock()
+
+		history, err := q.ledger.List()
+		if err != nil {
+			return err
+		}
+
+		err = q.limits.Check(o, history, time.Now())
+		if err != nil {
+			o.SetError(err)
+			next = q.stateForError(err)
+			if next == OrderRefundPending {
+				o.Excess = 0
+			}
+		}
+	}
+
+	if o.Excess > 0 && o.ExcessOrderId == "" {
+		err = q.splitExcess(o)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = q.ledger.Record(o, next)
+	if err != nil {
+		return err
+	}
+
+	if next == OrderHeld {
+		q.notifyHeld(o)
+	}
+	return nil
+}
+
+// splitExcess creates a second leg of the order to refund the part of the
+// payment over the maximum order size. The refund leg goes through the queue
+// like any other order.
+func (q *Queue) splitExcess(o *Order) error {
+	leg := Order{
+		Id:            o.Id + "-excess",
+		ParentId:      o.Id,
+		SortCode:      o.SortCode,
+		AccountNumber: o.AccountNumber,
+		Currency:      o.Currency,
+		Amount:        o.Excess,
+		EthAddress:    o.EthAddress,
+		Transaction:   o.Transaction,
+	}
+	leg.SetError(CustomerError(ReasonExcessAmount, fmt.Sprintf("Invalid amount. Send £%d - £%d. The excess has been refunded", MinOrderPence/100, MaxOrderPence/100)))
+
+	err := q.ledger.Receive(&leg)
+
+	// If we crashed after creating the leg last time it is already queued
+	if err != nil && err != ErrDuplicateOrder {
+		return err
+	}
+
+	log.Printf("Order %s: fulfilling %d and refunding the excess %d as order %s", o.Id, o.LegAmount(), o.Excess, leg.Id)
+
+	o.ExcessOrderId = leg.Id
+	if err == nil {
+		q.Push(leg.Id)
+	}
+	return nil
+}
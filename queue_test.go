@@ -0,0 +1,510 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	eth "github.com/ethereum/go-ethereum/common"
+)
+
+func newTestQueue(t *testing.T) (*Queue, *MockMonzo, *MockCoinbase, func()) {
+	dir, err := ioutil.TempDir("", "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &Ledger{dir: dir + "/"}
+
+	monzo := &MockMonzo{Pots: make(map[string]int)}
+
+	coinbase := &MockCoinbase{
+		EthAccounts: make(map[string]Wei),
+		EtherPrice:  100,
+	}
+
+	q := &Queue{
+		ledger: l,
+		logic: &Logic{
+			coinbase: coinbase,
+			monzo:    monzo,
+			ledger:   l,
+		},
+		workers:         2,
+		maxAttempts:     5,
+		backoff:         time.Millisecond,
+		maxBackoff:      10 * time.Millisecond,
+		settlementCheck: time.Hour,
+		policy:          &ErrorPolicy{},
+	}
+
+	return q, monzo, coinbase, func() {
+		q.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestOrder(id string) Order {
+	tx := MonzoWebHookTransaction{
+		Id:       id,
+		Amount:   1000,
+		Currency: "GBP",
+		CounterParty: MonzoWebHookCounterParty{
+			SortCode:      "123456",
+			AccountNumber: "123456789",
+		},
+	}
+
+	return Order{
+		Id:            tx.Id,
+		AccountNumber: "123456789",
+		Amount:        1000,
+		Currency:      "GBP",
+		EthAddress:    eth.HexToAddress("0x52Ec249dD2eEc428b1E2f389c7d032caF5D1a238"),
+		SortCode:      "123456",
+		Transaction:   tx,
+	}
+}
+
+func waitForState(t *testing.T, l *Ledger, id string, state OrderState) Order {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		o, err := l.Load(id)
+		if err == nil && o.State == state {
+			return o
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("order %s in state '%s', expected '%s'", id, o.State, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestQueueResumesAndRetriesOrders(t *testing.T) {
+	subject, monzo, coinbase, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	coinbase.PriceFailures = 2
+
+	// An order left behind by a previous run of the process
+	order := newTestOrder("tx_unfinished")
+	monzo.SetTransaction(order.Transaction)
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForState(t, subject.ledger, order.Id, OrderBooksBalanced)
+
+	if coinbase.EthAccounts["0x52Ec249dD2eEc428b1E2f389c7d032caF5D1a238"].Sign() == 0 {
+		t.Error("customer eth balance")
+	}
+}
+
+func TestQueueStopLeavesOrdersToResume(t *testing.T) {
+	subject, monzo, _, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+	subject.Stop()
+
+	// Pushed after stopping, so left in the ledger for the next start
+	order := newTestOrder("tx_afterstop")
+	monzo.SetTransaction(order.Transaction)
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(order.Id)
+	subject.Wait()
+
+	if o, _ := subject.ledger.Load(order.Id); o.State != OrderReceived {
+		t.Fatalf("order worked on after stopping: '%s'", o.State)
+	}
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, subject.ledger, order.Id, OrderBooksBalanced)
+}
+
+func TestQueueSweepsOrdersGivenUpOn(t *testing.T) {
+	subject, monzo, coinbase, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	subject.maxAttempts = 2
+	subject.sweep = 20 * time.Millisecond
+	coinbase.PriceFailures = 3
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	order := newTestOrder("tx_givenup")
+	monzo.SetTransaction(order.Transaction)
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(order.Id)
+
+	// Only the sweep tries again after the first push gives up
+	waitForState(t, subject.ledger, order.Id, OrderBooksBalanced)
+}
+
+func TestQueueRetriesFailedPotMoves(t *testing.T) {
+	subject, monzo, _, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	monzo.MoveFailEvery = 2
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	order := newTestOrder("tx_potfails")
+	monzo.SetTransaction(order.Transaction)
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(order.Id)
+	subject.Wait()
+
+	o := waitForState(t, subject.ledger, order.Id, OrderBooksBalanced)
+
+	// Every move was made exactly once
+	cost := o.Purchases[0].CostPence()
+	if len(o.Purchases) != 1 || monzo.Pots["coinbase"] != cost || monzo.Pots["profit"] != o.Commission ||
+		monzo.Pots["float"] != o.Amount-o.Commission-cost {
+		t.Errorf("pots %v, moves %v", monzo.Pots, o.PotMoves)
+	}
+}
+
+func TestQueueRejectsForgedOrder(t *testing.T) {
+	subject, monzo, _, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	order := newTestOrder("tx_forged")
+	genuine := order.Transaction
+	genuine.Amount = 100
+	monzo.SetTransaction(genuine)
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(order.Id)
+
+	waitForState(t, subject.ledger, order.Id, OrderRejected)
+}
+
+func TestQueueWaitsForSettlement(t *testing.T) {
+	subject, monzo, _, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	subject.settledOnly = true
+
+	order := newTestOrder("tx_unsettled")
+	monzo.SetTransaction(order.Transaction)
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(order.Id)
+
+	waitForState(t, subject.ledger, order.Id, OrderAwaitingSettlement)
+
+	settled := order.Transaction
+	settled.Settled = time.Now().Add(-time.Minute).Format(time.RFC3339)
+	monzo.SetTransaction(settled)
+
+	if err := subject.Update(settled); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForState(t, subject.ledger, order.Id, OrderBooksBalanced)
+}
+
+func TestQueueDeclinedPayments(t *testing.T) {
+	subject, monzo, _, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	pending := newTestOrder("tx_pending")
+	fulfilled := newTestOrder("tx_fulfilled")
+
+	for _, s := range []OrderState{OrderReceived, OrderValidated} {
+		if err := subject.ledger.Record(&pending, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range []OrderState{OrderReceived, OrderValidated, OrderPriced, OrderInventoryBought, OrderEtherSent, OrderBooksBalanced} {
+		if err := subject.ledger.Record(&fulfilled, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, o := range []Order{pending, fulfilled} {
+		tx := o.Transaction
+		tx.DeclineReason = "INSUFFICIENT_FUNDS"
+		monzo.SetTransaction(tx)
+
+		if err := subject.Update(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	o, _ := subject.ledger.Load(pending.Id)
+	if o.State != OrderCancelled {
+		t.Errorf("pending order state '%s'", o.State)
+	}
+
+	o, _ = subject.ledger.Load(fulfilled.Id)
+	if o.State != OrderBooksBalanced || o.Incident == "" {
+		t.Errorf("fulfilled order state '%s', incident '%s'", o.State, o.Incident)
+	}
+
+	if err := subject.Update(newTestOrder("tx_unknown").Transaction); err != ErrUnknownOrder {
+		t.Errorf("expected unknown order, got %v", err)
+	}
+}
+
+func TestQueueRefundsExcessOfLargePayment(t *testing.T) {
+	subject, monzo, coinbase, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	order := newTestOrder("tx_large")
+	order.Amount = 6000
+	order.Transaction.Amount = 6000
+	monzo.SetTransaction(order.Transaction)
+
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(order.Id)
+	subject.Wait()
+
+	o := waitForState(t, subject.ledger, order.Id, OrderBooksBalanced)
+	excess := waitForState(t, subject.ledger, o.ExcessOrderId, OrderRefunded)
+
+	if o.LegAmount() != MaxOrderPence || excess.LegAmount() != 1000 || excess.ParentId != o.Id {
+		t.Errorf("legs %d %d", o.LegAmount(), excess.LegAmount())
+	}
+
+	if monzo.Pots["refund"] != 1000 {
+		t.Errorf("refund pot %d", monzo.Pots["refund"])
+	}
+
+	if monzo.Pots["float"]+monzo.Pots["profit"]+monzo.Pots["coinbase"] != MaxOrderPence {
+		t.Errorf("fulfilled pots %v", monzo.Pots)
+	}
+
+	if coinbase.EthAccounts["0x52Ec249dD2eEc428b1E2f389c7d032caF5D1a238"].Sign() == 0 {
+		t.Error("customer eth balance")
+	}
+}
+
+func TestQueueRetriesFailedSend(t *testing.T) {
+	subject, monzo, coinbase, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	subject.logic.maxSendFailures = 3
+	coinbase.SendFailures = 2
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	order := newTestOrder("tx_sendretry")
+	monzo.SetTransaction(order.Transaction)
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(order.Id)
+	subject.Wait()
+
+	o := waitForState(t, subject.ledger, order.Id, OrderBooksBalanced)
+	if o.SendFailures != 2 {
+		t.Errorf("send failures %d", o.SendFailures)
+	}
+
+	if monzo.Pots["float"]+monzo.Pots["profit"]+monzo.Pots["coinbase"] != 1000 {
+		t.Errorf("pots %v", monzo.Pots)
+	}
+}
+
+func TestQueueGivesUpOnFailedSend(t *testing.T) {
+	for _, refund := range []bool{true, false} {
+		subject, monzo, coinbase, cleanup := newTestQueue(t)
+		defer cleanup()
+
+		subject.logic.maxSendFailures = 3
+		subject.policy = &ErrorPolicy{RefundFailedDelivery: refund}
+		coinbase.SendFailures = 100
+
+		if err := subject.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		order := newTestOrder("tx_sendfails")
+		monzo.SetTransaction(order.Transaction)
+		if err := subject.ledger.Receive(&order); err != nil {
+			t.Fatal(err)
+		}
+		subject.Push(order.Id)
+		subject.Wait()
+
+		expected := OrderHeld
+		if refund {
+			expected = OrderRefunded
+		}
+		o := waitForState(t, subject.ledger, order.Id, expected)
+
+		if o.SendFailures != 3 || o.ReasonCode != ReasonDeliveryFailed {
+			t.Errorf("send failures %d reason %s", o.SendFailures, o.ReasonCode)
+		}
+
+		// The Ether we bought stays in inventory and no pots are credited for it
+		if subject.logic.etherBalance.Cmp(o.EtherAmount) < 0 {
+			t.Errorf("ether balance %s", subject.logic.etherBalance.Ether())
+		}
+		if monzo.Pots["float"] != -monzo.Pots["coinbase"] || monzo.Pots["profit"] != 0 {
+			t.Errorf("pots %v", monzo.Pots)
+		}
+	}
+}
+
+func TestQueueDoesNotResendUncertainSend(t *testing.T) {
+	for _, lost := range []bool{true, false} {
+		subject, monzo, coinbase, cleanup := newTestQueue(t)
+		defer cleanup()
+
+		subject.policy = &ErrorPolicy{RefundFailedDelivery: true}
+		if lost {
+			// Coinbase made the withdrawal but the answer never arrived
+			coinbase.LostSends = 1
+		} else {
+			coinbase.NoAnswerSends = 1
+		}
+
+		if err := subject.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		order := newTestOrder(fmt.Sprintf("tx_uncertain%t", lost))
+		monzo.SetTransaction(order.Transaction)
+		if err := subject.ledger.Receive(&order); err != nil {
+			t.Fatal(err)
+		}
+		subject.Push(order.Id)
+		subject.Wait()
+
+		if lost {
+			o := waitForState(t, subject.ledger, order.Id, OrderBooksBalanced)
+			if o.WithdrawalId != "withdrawal-1" || len(coinbase.withdrawals) != 1 {
+				t.Errorf("withdrawal %s of %d", o.WithdrawalId, len(coinbase.withdrawals))
+			}
+			continue
+		}
+
+		// Neither sent again nor refunded until an operator has checked
+		o := waitForState(t, subject.ledger, order.Id, OrderHeld)
+		if o.ErrorKind != KindSendUncertain || len(coinbase.withdrawals) != 0 || monzo.Pots["refund"] != 0 {
+			t.Errorf("kind %s, withdrawals %d, pots %v", o.ErrorKind, len(coinbase.withdrawals), monzo.Pots)
+		}
+	}
+}
+
+func TestQueueFollowsWithdrawal(t *testing.T) {
+	subject, monzo, coinbase, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	coinbase.PendingWithdrawals = 2
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	order := newTestOrder("tx_withdrawal")
+	monzo.SetTransaction(order.Transaction)
+	if err := subject.ledger.Receive(&order); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(order.Id)
+	subject.Wait()
+
+	o, err := subject.ledger.Load(order.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.State != OrderEtherSending || o.WithdrawalId == "" || o.TxHash != "" {
+		t.Fatalf("state %s, withdrawal %s, tx %s", o.State, o.WithdrawalId, o.TxHash)
+	}
+
+	subject.withdrawalCheck = 5 * time.Millisecond
+	go subject.checkWithdrawals()
+
+	o = waitForState(t, subject.ledger, order.Id, OrderBooksBalanced)
+	if len(o.TxHash) != 66 || o.WithdrawalFee.Sign() <= 0 {
+		t.Errorf("tx %s, fee %s", o.TxHash, o.WithdrawalFee.Ether())
+	}
+}
+
+func TestQueueResendsFailedWithdrawal(t *testing.T) {
+	for _, failures := range []int{1, 100} {
+		subject, monzo, coinbase, cleanup := newTestQueue(t)
+		defer cleanup()
+
+		subject.logic.maxSendFailures = 3
+		subject.policy = &ErrorPolicy{RefundFailedDelivery: true}
+		coinbase.FailedWithdrawals = failures
+
+		if err := subject.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		order := newTestOrder(fmt.Sprintf("tx_failedwithdrawal%d", failures))
+		monzo.SetTransaction(order.Transaction)
+		if err := subject.ledger.Receive(&order); err != nil {
+			t.Fatal(err)
+		}
+		subject.Push(order.Id)
+		subject.Wait()
+
+		if failures == 1 {
+			o := waitForState(t, subject.ledger, order.Id, OrderBooksBalanced)
+			if o.SendFailures != 1 || o.WithdrawalId != "withdrawal-2" {
+				t.Errorf("send failures %d, withdrawal %s", o.SendFailures, o.WithdrawalId)
+			}
+			if coinbase.EthAccounts[o.EthAddress.String()].Cmp(o.EtherAmount) != 0 {
+				t.Error("customer eth balance")
+			}
+			continue
+		}
+
+		o := waitForState(t, subject.ledger, order.Id, OrderRefunded)
+		if o.SendFailures != 3 || o.ReasonCode != ReasonDeliveryFailed {
+			t.Errorf("send failures %d reason %s", o.SendFailures, o.ReasonCode)
+		}
+
+		// The Ether came back from every failed withdrawal
+		if subject.logic.EtherBalance().Cmp(coinbase.BalanceEth) != 0 || coinbase.BalanceEth.Cmp(o.EtherAmount) < 0 {
+			t.Errorf("ether balance %s, coinbase %s", subject.logic.EtherBalance().Ether(), coinbase.BalanceEth.Ether())
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Quote locks in the amount of Ether a customer will get for a payment made
+// with their access code before the quote expires
+type Quote struct {
+	AccessCode  string
+	AmountPence int
+	EtherPrice  float64
+	Fees        *FeeBreakdown
+	EtherAmount Wei
+	Created     time.Time
+	Expires     time.Time
+
+	// Set once an order has been fulfilled at the quoted price
+	OrderId string
+}
+
+// QuoteBook stores the latest quote for each access code
+type QuoteBook struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func (b *QuoteBook) Init() error {
+	return os.MkdirAll(b.dir, 0755)
+}
+
+func (b *QuoteBook) Save(q *Quote) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := WriteJSONFile(b.filename(q.AccessCode), q)
+	if err != nil {
+		return errors.New("Failed to save quote: " + err.Error())
+	}
+	return nil
+}
+
+// Load returns the latest quote for the access code, or nil if it has none
+func (b *QuoteBook) Load(accessCode string) (*Quote, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	dat, err := ioutil.ReadFile(b.filename(accessCode))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Quote{}
+	err = json.Unmarshal(dat, q)
+	return q, err
+}
+
+func (b *QuoteBook) filename(accessCode string) string {
+	return fmt.Sprintf("%s%s.json", b.dir, accessCode)
+}
+
+// Quote prices a payment of the given amount at the current rate and saves the
+// quote against the access code, replacing any earlier quote
+func (l *Logic) Quote(accessCode string, amountPence int, now time.Time) (*Quote, error) {
+	if amountPence < MinOrderPence || amountPence > MaxOrderPence {
+		return nil, CustomerError(ReasonInvalidAmount, fmt.Sprintf("Invalid amount. Send £%d - £%d", MinOrderPence/100, MaxOrderPence/100))
+	}
+
+	err := l.CanTrade()
+	if err != nil {
+		return nil, err
+	}
+
+	etherPrice, fees, etherAmount, err := l.Price(amountPence)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Quote{
+		AccessCode:  accessCode,
+		AmountPence: amountPence,
+		EtherPrice:  etherPrice,
+		Fees:        &fees,
+		EtherAmount: etherAmount,
+		Created:     now.UTC(),
+		Expires:     now.UTC().Add(l.quoteValidity),
+	}
+
+	err = l.quotes.Save(q)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// quoteFor returns the quote the order should be priced at, or nil if it
+// should be priced live. A quote that has expired or is for a different amount
+// is an error if stale quotes are refunded.
+func (l *Logic) quoteFor(o *Order) (*Quote, error) {
+	if l.quotes == nil || o.AccessCode == "" {
+		return nil, nil
+	}
+
+	q, err := l.quotes.Load(o.AccessCode)
+	if err != nil {
+		return nil, errors.New("Failed to load quote: " + err.Error())
+	}
+	if q == nil || (q.OrderId != "" && q.OrderId != o.Id) {
+		return nil, nil
+	}
+
+	// The payment counts as arriving when we received it, however long it
+	// took to get to this point
+	received := time.Now().UTC()
+	if len(o.Transitions) > 0 {
+		received = o.Transitions[0].Time
+	}
+
+	var stale error
+	switch {
+	case received.After(q.Expires):
+		stale = CustomerError(ReasonQuoteExpired, "Quote expired before the payment arrived")
+	case q.AmountPence != o.LegAmount():
+		stale = CustomerError(ReasonQuoteMismatch, fmt.Sprintf("Payment of %d does not match quote for %d", o.LegAmount(), q.AmountPence))
+	}
+
+	if stale != nil {
+		o.ReferenceNotes = append(o.ReferenceNotes, stale.Error())
+		if l.refundStaleQuotes {
+			return nil, stale
+		}
+		return nil, nil
+	}
+
+	q.OrderId = o.Id
+	err = l.quotes.Save(q)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFulfillHonoursQuote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quotes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	coinbase := &MockCoinbase{EthAccounts: make(map[string]Wei), EtherPrice: 100}
+
+	subject := Logic{
+		coinbase:      coinbase,
+		monzo:         &MockMonzo{Pots: make(map[string]int)},
+		ledger:        &Ledger{dir: dir + "/"},
+		quotes:        &QuoteBook{dir: dir + "/"},
+		quoteValidity: 15 * time.Minute,
+	}
+
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		quoted   time.Time
+		amount   int
+		refund   bool
+		expected string
+		err      string
+	}{
+		{"in time", now.Add(-10 * time.Minute), 1000, false, "0.085", ""},
+		{"expired", now.Add(-20 * time.Minute), 1000, false, "0.0425", ""},
+		{"different amount", now, 2000, false, "0.0425", ""},
+		{"expired refund", now.Add(-20 * time.Minute), 1000, true, "", ReasonQuoteExpired},
+		{"different amount refund", now, 2000, true, "", ReasonQuoteMismatch},
+	}
+
+	for _, test := range tests {
+		coinbase.EtherPrice = 100
+		subject.refundStaleQuotes = test.refund
+
+		if _, err := subject.Quote("15492100001", test.amount, test.quoted); err != nil {
+			t.Fatal(err)
+		}
+
+		// The price doubles between the quote and the payment
+		coinbase.EtherPrice = 200
+
+		o := newTestOrder("tx_quoted")
+		o.AccessCode = "15492100001"
+		o.State = OrderValidated
+		o.Transitions = []OrderTransition{{State: OrderReceived, Time: now.UTC()}}
+
+		err := subject.Fulfill(&o)
+
+		if test.err != "" {
+			if AsOrderError(err).Reason != test.err {
+				t.Errorf("%s: error %v", test.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		if o.EtherAmount.Ether() != test.expected {
+			t.Errorf("%s: ether amount %s", test.name, o.EtherAmount.Ether())
+		}
+		if o.Quoted != (test.name == "in time") {
+			t.Errorf("%s: quoted %t", test.name, o.Quoted)
+		}
+	}
+
+	// A quote can only be used once
+	if _, err := subject.Quote("15492100001", 1000, now); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"tx_first", "tx_second"} {
+		o := newTestOrder(id)
+		o.AccessCode = "15492100001"
+		o.State = OrderValidated
+		o.Transitions = []OrderTransition{{State: OrderReceived, Time: now.UTC()}}
+
+		if err := subject.Fulfill(&o); err != nil {
+			t.Fatal(err)
+		}
+		if o.Quoted != (id == "tx_first") {
+			t.Errorf("%s: quoted %t", id, o.Quoted)
+		}
+	}
+}
+
+func TestIndexShowsQuoteValidity(t *testing.T) {
+	var b bytes.Buffer
+	if err := templates["index"].Execute(&b, IndexViewModel{QuoteValidityMinutes: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "within 30 minutes") {
+		t.Error("quote validity not shown")
+	}
+}
+
+func TestIndexDescribesPartialFulfilment(t *testing.T) {
+	for _, partial := range []bool{false, true} {
+		var b bytes.Buffer
+		if err := templates["index"].Execute(&b, IndexViewModel{PartialFulfilment: partial}); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(b.String(), "refund the rest") != partial {
+			t.Errorf("partial fulfilment %t not described", partial)
+		}
+	}
+}
+
+func TestIndexShowsLimits(t *testing.T) {
+	var b bytes.Buffer
+	vm := IndexViewModel{DailyLimitGBP: 150, WeeklyLimitGBP: 400, MonthlyLimitGBP: 1000}
+	if err := templates["index"].Execute(&b, vm); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "£150 a day, £400 a week and £1000 a month") {
+		t.Error("limits not shown")
+	}
+}
+
+func TestGetQuoteRejectsMalformedAccessCodes(t *testing.T) {
+	for code, valid := range map[string]bool{
+		"15492100001":  true,
+		"1549210000":   true,
+		"154921000012": false,
+		"1549210x001":  false,
+		"../orders/x":  false,
+		"":             false,
+	} {
+		if IsValidAccessCode(code) != valid {
+			t.Errorf("%q: expected valid %v", code, valid)
+		}
+	}
+
+	form := url.Values{"access-code": {"../../etc/passwd"}, "amount-pence": {"1000"}}
+	r := httptest.NewRequest("POST", "/get-quote", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	getQuoteHandler(w, r)
+
+	if !strings.Contains(w.Body.String(), "Unknown access code") {
+		t.Errorf("Expected the access code to be refused, got %s", w.Body.String())
+	}
+}
+
+func TestGetQuoteIsRateLimited(t *testing.T) {
+	status := func(remote string) int {
+		r := httptest.NewRequest("POST", "/get-quote", strings.NewReader("access-code=x"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		getQuoteHandler(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < QuoteRateLimit; i++ {
+		status("10.0.0.1:1000")
+	}
+	if s := status("10.0.0.1:1000"); s != http.StatusTooManyRequests {
+		t.Errorf("Expected a quote over the limit to be refused, got %d", s)
+	}
+	if s := status("10.0.0.2:1000"); s != http.StatusOK {
+		t.Errorf("Expected another client to be quoted, got %d", s)
+	}
+}
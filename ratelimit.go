@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter allows each key at most Max requests in any Period
+type RateLimiter struct {
+	Max    int
+	Period time.Duration
+
+	mu   sync.Mutex
+	seen map[string][]time.Time
+}
+
+// Allow records a request for key and reports whether it is within the limit
+func (l *RateLimiter) Allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seen == nil {
+		l.seen = make(map[string][]time.Time)
+	}
+
+	// Forget requests that have dropped out of the period
+	var recent []time.Time
+	for _, t := range l.seen[key] {
+		if now.Sub(t) < l.Period {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) >= l.Max {
+		l.seen[key] = recent
+		return false
+	}
+
+	l.seen[key] = append(recent, now)
+	return true
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	subject := RateLimiter{Max: 2, Period: time.Minute}
+	now := time.Date(2019, 2, 3, 12, 0, 0, 0, time.UTC)
+
+	if !subject.Allow("a", now) || !subject.Allow("a", now.Add(time.Second)) {
+		t.Fatalf("Requests within the limit refused")
+	}
+	if subject.Allow("a", now.Add(2*time.Second)) {
+		t.Errorf("Request over the limit allowed")
+	}
+	if !subject.Allow("b", now.Add(2*time.Second)) {
+		t.Errorf("Another key was limited")
+	}
+	if !subject.Allow("a", now.Add(time.Minute)) {
+		t.Errorf("Request allowed again after the period was refused")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WebHookRecording is a webhook exactly as we received it, so that it can be
+// replayed later
+type WebHookRecording struct {
+	Time    time.Time
+	Headers http.Header
+	Body    string
+}
+
+// RecordWebHook saves the raw webhook to disk. The request body is replaced so
+// it can still be read afterwards.
+func RecordWebHook(dir string, r *http.Request) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	rec := WebHookRecording{
+		Time:    time.Now().UTC(),
+		Headers: r.Header,
+		Body:    string(body),
+	}
+
+	dat, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	filename := fmt.Sprintf("%s%d.json", dir, rec.Time.UnixNano())
+	err = ioutil.WriteFile(filename, dat, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to record webhook: %s", err.Error())
+	}
+
+	return nil
+}
+
+// LoadWebHookRecordings loads recordings from the given files and directories,
+// oldest first
+func LoadWebHookRecordings(paths []string) ([]WebHookRecording, error) {
+	var filenames []string
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			filenames = append(filenames, p)
+			continue
+		}
+
+		files, err := ioutil.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if strings.HasSuffix(f.Name(), ".json") {
+				filenames = append(filenames, filepath.Join(p, f.Name()))
+			}
+		}
+	}
+
+	var recordings []WebHookRecording
+	for _, filename := range filenames {
+		dat, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		rec := WebHookRecording{}
+		err = json.Unmarshal(dat, &rec)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse recording %s: %s", filename, err.Error())
+		}
+
+		recordings = append(recordings, rec)
+	}
+
+	sort.SliceStable(recordings, func(i, j int) bool {
+		return recordings[i].Time.Before(recordings[j].Time)
+	})
+
+	return recordings, nil
+}
+
+// Request rebuilds the webhook request
+func (rec WebHookRecording) Request() *http.Request {
+	r, _ := http.NewRequest("POST", "/monzo-webhook", strings.NewReader(rec.Body))
+	for name, values := range rec.Headers {
+		for _, v := range values {
+			r.Header.Add(name, v)
+		}
+	}
+	return r
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplayWebHook(t *testing.T) {
+	recordings, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(recordings)
+
+	orders, err := ioutil.TempDir("", "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(orders)
+
+	body, err := ioutil.ReadFile("monzo-webhook.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("POST", "/monzo-webhook", strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/json")
+
+	if err := RecordWebHook(recordings+"/", r); err != nil {
+		t.Fatal(err)
+	}
+
+	// The body can still be read after recording
+	after, _ := ioutil.ReadAll(r.Body)
+	if string(after) != string(body) {
+		t.Error("request body consumed by recording")
+	}
+
+	// A live secondary source disagrees with the fake Coinbase's price
+	secondary := priceGuard.secondary
+	priceGuard.secondary = &MockPriceSource{Price: 5000}
+	defer func() { priceGuard.secondary = secondary }()
+
+	if err := Replay([]string{"-ledger", orders, recordings}); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := (&Ledger{dir: orders + "/"}).Load("tx_00009exl5Ni96JK2NMC9c9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.State != OrderBooksBalanced {
+		t.Errorf("replayed order state '%s'", o.State)
+	}
+	if o.EthAddress.Hex() != "0xDaEF995931D6F00F56226b29ba70353327b21E00" {
+		t.Errorf("replayed order address %s", o.EthAddress.Hex())
+	}
+
+	// Quotes are looked up beside the replayed orders, not in the live book
+	if logic.quotes.dir != orders+"/quotes/" || logic.maintenance.file != orders+"/maintenance/paused.json" {
+		t.Errorf("replay used quotes %s and pause %s", logic.quotes.dir, logic.maintenance.file)
+	}
+}
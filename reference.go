@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	eth "github.com/ethereum/go-ethereum/common"
+)
+
+var referenceAddressPattern = regexp.MustCompile("(?i)0x[0-9a-f]{40,}")
+var referenceDigitsPattern = regexp.MustCompile("[0-9][0-9 \\-]*[0-9]|[0-9]")
+
+// NewAccessCode makes an access code from the time it was issued plus a Luhn
+// check digit, so that a mistyped code is recognised as such
+func NewAccessCode(t time.Time) string {
+	code := strconv.FormatInt(t.Unix(), 10)
+	return code + strconv.Itoa(luhnCheckDigit(code))
+}
+
+func IsValidAccessCodeChecksum(code string) bool {
+	if len(code) < 2 {
+		return false
+	}
+	last := int(code[len(code)-1] - '0')
+	return luhnCheckDigit(code[:len(code)-1]) == last
+}
+
+// luhnCheckDigit returns the digit that, appended to the given digits, makes
+// them pass the Luhn check
+func luhnCheckDigit(digits string) int {
+	sum := 0
+	double := true
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return (10 - sum%10) % 10
+}
+
+// ParseReference works out which Ethereum address to send Ether to from the
+// free text reference on a bank transfer. The reference may contain an access
+// code or an Ethereum address surrounded by other text added by the customer
+// or their bank. Every way the reference was interpreted is returned in notes.
+func ParseReference(ref string, lookup func(accessCode string) (string, error)) (address eth.Address, notes []string, err error) {
+	notes = append(notes, fmt.Sprintf("Reference %q", ref))
+
+	var found []eth.Address
+
+	for _, m := range referenceAddressPattern.FindAllString(ref, -1) {
+		if len(m) != 42 {
+			notes = append(notes, fmt.Sprintf("Ignored %s: too long to be an Ethereum address", m))
+			continue
+		}
+
+		// Banks often change the case of references, so the checksum can only
+		// be checked if the case has been preserved
+		hex := m[2:]
+		if strings.ToLower(hex) != hex && strings.ToUpper(hex) != hex && eth.HexToAddress(m).Hex()[2:] != hex {
+			notes = append(notes, fmt.Sprintf("Ignored %s: Ethereum address checksum does not match", m))
+			continue
+		}
+
+		notes = append(notes, fmt.Sprintf("Found Ethereum address %s", m))
+		found = append(found, eth.HexToAddress(m))
+	}
+
+	// Addresses contain digits, so take them out before looking for access codes
+	rest := referenceAddressPattern.ReplaceAllString(ref, " ")
+
+	for _, m := range referenceDigitsPattern.FindAllString(rest, -1) {
+		for _, code := range accessCodeCandidates(m) {
+			switch {
+			case len(code) == AccessCodeLength && IsValidAccessCodeChecksum(code):
+				notes = append(notes, fmt.Sprintf("Found access code %s", code))
+			case len(code) == LegacyAccessCodeLength:
+				notes = append(notes, fmt.Sprintf("Found access code %s without a checksum", code))
+			case len(code) == AccessCodeLength:
+				notes = append(notes, fmt.Sprintf("Ignored %s: access code checksum does not match", code))
+				continue
+			default:
+				notes = append(notes, fmt.Sprintf("Ignored %s: not an access code", code))
+				continue
+			}
+
+			a, err := lookup(code)
+			if err != nil {
+				notes = append(notes, fmt.Sprintf("Unknown access code %s", code))
+				continue
+			}
+
+			notes = append(notes, fmt.Sprintf("Access code %s is for %s", code, strings.TrimSpace(a)))
+			found = append(found, eth.HexToAddress(strings.TrimSpace(a)))
+		}
+	}
+
+	var distinct []eth.Address
+	for _, a := range found {
+		duplicate := false
+		for _, d := range distinct {
+			if d == a {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			distinct = append(distinct, a)
+		}
+	}
+
+	switch len(distinct) {
+	case 0:
+		return address, notes, CustomerError(ReasonUnknownAccessCode, "Unknown access code")
+	case 1:
+		return distinct[0], notes, nil
+	default:
+		return address, notes, CustomerError(ReasonAmbiguousReference, "Ambiguous reference, it refers to more than one Ethereum address")
+	}
+}
+
+// accessCodeCandidates returns the digits in a run of digits that may be split
+// up by spaces or dashes, such as "1549 2100 003". If the whole run is not the
+// right length for an access code, each part of it is tried separately.
+func accessCodeCandidates(run string) []string {
+	joined := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, run)
+
+	if len(joined) == AccessCodeLength || len(joined) == LegacyAccessCodeLength {
+		return []string{joined}
+	}
+
+	parts := strings.FieldsFunc(run, func(r rune) bool {
+		return r == ' ' || r == '-'
+	})
+	if len(parts) < 2 {
+		return []string{joined}
+	}
+	return parts
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseReference(t *testing.T) {
+	code := NewAccessCode(time.Unix(1549210000, 0))
+
+	codes := map[string]string{
+		code:         "0x52Ec249dD2eEc428b1E2f389c7d032caF5D1a238",
+		"1549210000": "0xDaEF995931D6F00F56226b29ba70353327b21E00\n",
+		"1549219999": "0x52Ec249dD2eEc428b1E2f389c7d032caF5D1a238",
+	}
+	lookup := func(c string) (string, error) {
+		a, ok := codes[c]
+		if !ok {
+			return "", errors.New("not found")
+		}
+		return a, nil
+	}
+
+	tests := []struct {
+		ref     string
+		address string
+	}{
+		{code, "0x52Ec249dD2eEc428b1E2f389c7d032caF5D1a238"},
+		{"  " + code + "  ", "0x52Ec249dD2eEc428b1E2f389c7d032caF5D1a238"},
+		{"Ref " + code, "0x52Ec249dD2eEc428b1E2f389c7d032caF5D1a238"},
+		{"ref:" + code[:4] + " " + code[4:8] + " " + code[8:], "0x52Ec249dD2eEc428b1E2f389c7d032caF5D1a238"},
+		{"1549210000", "0xDaEF995931D6F00F56226b29ba70353327b21E00"},
+		{"REF 1549210000 FROM J SMITH", "0xDaEF995931D6F00F56226b29ba70353327b21E00"},
+		{"0xDaEF995931D6F00F56226b29ba70353327b21E00", "0xDaEF995931D6F00F56226b29ba70353327b21E00"},
+		{"0XDAEF995931D6F00F56226B29BA70353327B21E00", "0xDaEF995931D6F00F56226b29ba70353327b21E00"},
+		{"eth 0xdaef995931d6f00f56226b29ba70353327b21e00 thanks", "0xDaEF995931D6F00F56226b29ba70353327b21E00"},
+		{"1549210000 0xDaEF995931D6F00F56226b29ba70353327b21E00", "0xDaEF995931D6F00F56226b29ba70353327b21E00"},
+	}
+
+	for _, test := range tests {
+		address, notes, err := ParseReference(test.ref, lookup)
+		if err != nil {
+			t.Errorf("%q: %s %v", test.ref, err.Error(), notes)
+			continue
+		}
+		if address.Hex() != test.address {
+			t.Errorf("%q: got %s", test.ref, address.Hex())
+		}
+		if len(notes) < 2 {
+			t.Errorf("%q: not enough notes %v", test.ref, notes)
+		}
+	}
+
+	// A mistyped check digit
+	mistyped := code[:10] + string('0'+(code[10]-'0'+1)%10)
+
+	for _, ref := range []string{
+		"",
+		"hello",
+		"1549219998",
+		mistyped,
+		"0xDaEF995931D6F00F56226b29ba70353327b21e00",
+		"1549210000 1549219999",
+	} {
+		if _, notes, err := ParseReference(ref, lookup); err == nil {
+			t.Errorf("%q: expected an error %v", ref, notes)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+)
+
+// Replay feeds recorded webhooks back through ProcessOrder and prints what
+// happened to each order. Usage:
+//
+//	etherdirect replay [-monzo fake|dry-run|real] [-coinbase fake|dry-run|real] [-price 100] [-ledger dir] recording...
+//
+// Recordings can be files or directories of files written by RecordWebHook.
+// The real and dry-run Monzo modes read the access token from MonzoAccessToken.
+// Refunds are only paid out by the configured bank in the real Monzo mode.
+// Quotes and the maintenance pause are kept under the ledger directory, apart
+// from the live service's.
+func Replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	monzoMode := flags.String("monzo", "fake", "Monzo implementation: fake, dry-run or real")
+	coinbaseMode := flags.String("coinbase", "fake", "Coinbase implementation: fake, dry-run or real")
+	price := flags.Float64("price", 100, "Ether price in GBP used by the fake Coinbase")
+	ledgerDir := flags.String("ledger", "", "Directory to record the replayed orders in. Defaults to a new temporary directory")
+	flags.Parse(args)
+
+	recordings, err := LoadWebHookRecordings(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	fakeMonzo := &FakeMonzo{}
+	switch *monzoMode {
+	case "fake":
+		logic.monzo = fakeMonzo
+		if logic.bank != nil {
+			fakeBank := httptest.NewServer(&FakeBankApi{Token: "fake"})
+			defer fakeBank.Close()
+			logic.bank = &HttpBank{root: fakeBank.URL + "/", token: "fake"}
+		}
+	case "dry-run":
+		monzoClient.UseAccessToken(os.Getenv("MonzoAccessToken"))
+		logic.monzo = &DryRunMonzo{monzo: &monzoClient}
+		if logic.bank != nil {
+			logic.bank = &DryRunBank{}
+		}
+	case "real":
+		monzoClient.UseAccessToken(os.Getenv("MonzoAccessToken"))
+		logic.monzo = &monzoClient
+	default:
+		return errors.New("Unknown Monzo implementation: " + *monzoMode)
+	}
+
+	switch *coinbaseMode {
+	case "fake":
+		logic.coinbase = &FakeCoinbase{EtherPrice: *price}
+	case "dry-run":
+		logic.coinbase = &DryRunCoinbase{coinbase: &coinbaseClient}
+	case "real":
+		logic.coinbase = &coinbaseClient
+	default:
+		return errors.New("Unknown Coinbase implementation: " + *coinbaseMode)
+	}
+
+	// A replay must never halt or resume the live service
+	logic.guard = &PriceGuard{
+		MaxDeviationPercent:       priceGuard.MaxDeviationPercent,
+		Window:                    priceGuard.Window,
+		MaxSpreadPercent:          priceGuard.MaxSpreadPercent,
+		MinDepthPence:             priceGuard.MinDepthPence,
+		MaxSourceDeviationPercent: priceGuard.MaxSourceDeviationPercent,
+	}
+
+	// The secondary source only agrees with real prices, and a fake replay
+	// should not need the network
+	if *coinbaseMode == "real" {
+		logic.guard.secondary = priceGuard.secondary
+	}
+
+	if *ledgerDir == "" {
+		*ledgerDir, err = ioutil.TempDir("", "etherdirect-replay")
+		if err != nil {
+			return err
+		}
+	}
+	replayed := &Ledger{dir: *ledgerDir + "/"}
+	err = replayed.Init()
+	if err != nil {
+		return err
+	}
+	logic.ledger = replayed
+
+	// Nor read or change its quotes and pause
+	logic.quotes = &QuoteBook{dir: *ledgerDir + "/quotes/"}
+	err = logic.quotes.Init()
+	if err != nil {
+		return err
+	}
+	logic.maintenance = &Maintenance{file: *ledgerDir + "/maintenance/paused.json"}
+
+	log.Printf("Replaying %d webhooks into %s", len(recordings), replayed.dir)
+
+	// A queue of its own, set up like the live one, so the live queue is
+	// never restarted
+	q := &Queue{
+		ledger:      replayed,
+		logic:       &logic,
+		workers:     queue.workers,
+		maxAttempts: queue.maxAttempts,
+		backoff:     queue.backoff,
+		maxBackoff:  queue.maxBackoff,
+
+		settledOnly:     queue.settledOnly,
+		settlementCheck: queue.settlementCheck,
+		withdrawalCheck: queue.withdrawalCheck,
+		sweep:           queue.sweep,
+		limits:          queue.limits,
+		policy:          queue.policy,
+		review:          queue.review,
+
+		inventorySync:      queue.inventorySync,
+		inventoryTolerance: queue.inventoryTolerance,
+		band:               queue.band,
+		rebalance:          queue.rebalance,
+
+		maintenanceCheck: queue.maintenanceCheck,
+	}
+	err = q.Start()
+	if err != nil {
+		return err
+	}
+	defer q.Stop()
+
+	for _, rec := range recordings {
+
+		// The fake Monzo should agree that the transaction exists, as the real one did
+		if *monzoMode == "fake" {
+			data := MonzoWebHook{}
+			if json.Unmarshal([]byte(rec.Body), &data) == nil {
+				fakeMonzo.SetTransaction(data.Data)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		HandleError(ProcessOrder(q, w, rec.Request()))
+		log.Printf("Replayed webhook received at %s: %d", rec.Time, w.Code)
+
+		// Finish each webhook before the next so the results are repeatable
+		q.Wait()
+	}
+
+	orders, err := replayed.List()
+	if err != nil {
+		return err
+	}
+
+	for _, o := range orders {
+		PrintOrder(o)
+	}
+
+	return nil
+}
+
+func PrintOrder(o Order) {
+	fmt.Println(o)
+	for _, t := range o.Transitions {
+		fmt.Printf("    %s %s\n", t.Time.Format("2006-01-02 15:04:05.000"), t.State)
+	}
+	if o.TxHash != "" {
+		fmt.Printf("    Transaction: %s\n", o.TxHash)
+	}
+	if o.Error != "" {
+		fmt.Printf("    Error: %s\n", o.Error)
+	}
+	if o.Incident != "" {
+		fmt.Printf("    Incident: %s\n", o.Incident)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	eth "github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	ReviewApprove = "approve"
+	ReviewDecline = "decline"
+)
+
+// RefundDecision is an operator's decision about a refund under review
+type RefundDecision struct {
+	Action   string
+	Operator string
+	FeePence int
+	Note     string
+	Time     time.Time
+}
+
+// RefundReviewPolicy decides which refunds must be approved by an operator
+// before they are paid
+type RefundReviewPolicy struct {
+	AbovePence int
+
+	// Counterparties keyed by sort code and account number
+	Flagged map[string]bool
+}
+
+// Reason says why the refund must be reviewed, or returns "" if it can be paid
+// straight away
+func (p *RefundReviewPolicy) Reason(o *Order) string {
+	if p.Flagged[counterpartyKey(o.SortCode, o.AccountNumber)] {
+		return "flagged counterparty"
+	}
+	if p.AbovePence > 0 && o.LegAmount() > p.AbovePence {
+		return fmt.Sprintf("refund of %d is over %d", o.LegAmount(), p.AbovePence)
+	}
+	return ""
+}
+
+// LoadFlagged reads flagged counterparties from a file with one sort code and
+// account number per line. Blank lines and lines starting with # are ignored.
+// A missing file flags nobody.
+func (p *RefundReviewPolicy) LoadFlagged(filename string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p.Flagged = make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return errors.New("Invalid flagged counterparty: " + line)
+		}
+		p.Flagged[counterpartyKey(fields[0], fields[1])] = true
+	}
+
+	return scanner.Err()
+}
+
+func counterpartyKey(sortCode string, accountNumber string) string {
+	return sortCode + " " + accountNumber
+}
+
+// holdForReview puts the refund in the review queue if the policy says an
+// operator must approve it. Reports whether it did.
+func (q *Queue) holdForReview(o *Order, err error) (bool, error) {
+	if q.review == nil || o.RefundReview != nil {
+		return false, nil
+	}
+
+	reason := q.review.Reason(o)
+	if reason == "" {
+		return false, nil
+	}
+
+	if o.State != OrderRefundPending {
+		o.SetError(err)
+		err2 := q.ledger.Record(o, OrderRefundPending)
+		if err2 != nil {
+			return true, err2
+		}
+	}
+
+	err2 := q.ledger.Record(o, OrderRefundReview)
+	if err2 != nil {
+		return true, err2
+	}
+
+	q.logic.monzo.PostInfo("REFUND REVIEW", fmt.Sprintf("Order %s refund of %d waiting for review: %s", o.Id, o.LegAmount(), reason))
+	return true, nil
+}
+
+// ReviewRefund records an operator's decision about a refund under review.
+// Approved refunds, less any fee, are queued to be paid.
+func (q *Queue) ReviewRefund(orderId string, d RefundDecision) error {
+	if d.Action != ReviewApprove && d.Action != ReviewDecline {
+		return errors.New("Unknown review action: " + d.Action)
+	}
+	if d.Operator == "" {
+		return errors.New("Review has no operator")
+	}
+
+	unlock := q.lock(orderId)
+	defer unlock()
+
+	o, err := q.ledger.Load(orderId)
+	if err != nil {
+		return errors.New("Failed to load order " + orderId + ": " + err.Error())
+	}
+
+	if o.State != OrderRefundReview {
+		return fmt.Errorf("Order %s is not waiting for review, it is %s", o.Id, o.State)
+	}
+
+	if d.FeePence < 0 || d.FeePence >= o.LegAmount() {
+		return fmt.Errorf("Fee %d must be at least 0 and less than the refund of %d", d.FeePence, o.LegAmount())
+	}
+
+	d.Time = time.Now().UTC()
+	o.RefundReview = &d
+
+	next := OrderRefundPending
+	if d.Action == ReviewDecline {
+		next = OrderRefundDeclined
+	}
+
+	err = q.ledger.Record(&o, next)
+	if err != nil {
+		return err
+	}
+
+	if next == OrderRefundPending {
+		q.Push(o.Id)
+	}
+	return nil
+}
+
+const (
+	ReleaseFulfil = "fulfil"
+	ReleaseRefund = "refund"
+	ReleaseCancel = "cancel"
+)
+
+// HoldRelease is an operator's decision about a held order
+type HoldRelease struct {
+	Action   string
+	Operator string
+	Note     string
+	Time     time.Time
+}
+
+func canFulfil(o *Order) bool {
+	return o.EthAddress != (eth.Address{}) && o.ErrorKind != KindCounterpartyMissing && o.ErrorKind != KindUpstreamPermanent
+}
+
+// ReleaseHeld records an operator's decision about a held order and queues it
+// to be fulfilled or refunded, or cancels it if the operator has dealt with
+// the payment some other way
+func (q *Queue) ReleaseHeld(orderId string, r HoldRelease) error {
+	next := map[string]OrderState{
+		ReleaseFulfil: OrderValidated,
+		ReleaseRefund: OrderRefundPending,
+		ReleaseCancel: OrderCancelled,
+	}[r.Action]
+	if next == "" {
+		return errors.New("Unknown release action: " + r.Action)
+	}
+	if r.Operator == "" {
+		return errors.New("Release has no operator")
+	}
+
+	unlock := q.lock(orderId)
+	defer unlock()
+
+	o, err := q.ledger.Load(orderId)
+	if err != nil {
+		return errors.New("Failed to load order " + orderId + ": " + err.Error())
+	}
+
+	if o.State != OrderHeld {
+		return fmt.Errorf("Order %s is not held, it is %s", o.Id, o.State)
+	}
+
+	// Only an order that was read in full has somewhere to send Ether to
+	if next == OrderValidated && !canFulfil(&o) {
+		return fmt.Errorf("Order %s cannot be fulfilled, it has no Ethereum address or was held for %s", o.Id, o.ErrorKind)
+	}
+
+	r.Time = time.Now().UTC()
+	o.HoldReleases = append(o.HoldReleases, r)
+
+	err = q.ledger.Record(&o, next)
+	if err != nil {
+		return err
+	}
+
+	if next != OrderCancelled {
+		q.Push(o.Id)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	eth "github.com/ethereum/go-ethereum/common"
+)
+
+func TestRefundReviewPolicy(t *testing.T) {
+	subject := RefundReviewPolicy{
+		AbovePence: 500,
+		Flagged:    map[string]bool{counterpartyKey("654321", "87654321"): true},
+	}
+
+	o := newTestOrder("tx_review")
+	o.Amount = 500
+	if reason := subject.Reason(&o); reason != "" {
+		t.Errorf("refund at threshold reviewed: %s", reason)
+	}
+
+	o.Amount = 501
+	if subject.Reason(&o) == "" {
+		t.Error("refund over threshold not reviewed")
+	}
+
+	o.Amount = 100
+	o.SortCode = "654321"
+	o.AccountNumber = "87654321"
+	if subject.Reason(&o) == "" {
+		t.Error("flagged counterparty not reviewed")
+	}
+}
+
+func TestRefundWaitsForOperatorApproval(t *testing.T) {
+	subject, monzo, _, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	subject.review = &RefundReviewPolicy{AbovePence: 500}
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"tx_approved", "tx_declined"} {
+		order := newTestOrder(id)
+		order.SetError(CustomerError(ReasonInvalidAmount, "Invalid amount"))
+		monzo.SetTransaction(order.Transaction)
+		if err := subject.ledger.Receive(&order); err != nil {
+			t.Fatal(err)
+		}
+		subject.Push(order.Id)
+	}
+	subject.Wait()
+
+	waitForState(t, subject.ledger, "tx_approved", OrderRefundReview)
+	waitForState(t, subject.ledger, "tx_declined", OrderRefundReview)
+
+	server := httptest.NewServer(Operators{"alice": "secret"}.Require(RefundReviewHandler(subject)))
+	defer server.Close()
+
+	review := func(password string, form url.Values) int {
+		req, _ := http.NewRequest("POST", server.URL, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("alice", password)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	approve := url.Values{"id": {"tx_approved"}, "action": {ReviewApprove}, "fee": {"100"}}
+	if status := review("wrong", approve); status != http.StatusUnauthorized {
+		t.Errorf("unauthenticated review status %d", status)
+	}
+	if status := review("secret", approve); status != http.StatusOK {
+		t.Errorf("approve status %d", status)
+	}
+	if status := review("secret", url.Values{"id": {"tx_declined"}, "action": {ReviewDecline}}); status != http.StatusOK {
+		t.Errorf("decline status %d", status)
+	}
+	subject.Wait()
+
+	approved := waitForState(t, subject.ledger, "tx_approved", OrderRefunded)
+	if approved.RefundReview == nil || approved.RefundReview.Operator != "alice" || approved.RefundReview.FeePence != 100 {
+		t.Errorf("review %v", approved.RefundReview)
+	}
+
+	declined := waitForState(t, subject.ledger, "tx_declined", OrderRefundDeclined)
+	if declined.RefundReview == nil || declined.RefundReview.Action != ReviewDecline {
+		t.Errorf("review %v", declined.RefundReview)
+	}
+
+	if monzo.Pots["refund"] != 900 || monzo.Pots["profit"] != 100 {
+		t.Errorf("pots %v", monzo.Pots)
+	}
+}
+
+func TestOperatorReleasesHeldOrders(t *testing.T) {
+	subject, monzo, coinbase, cleanup := newTestQueue(t)
+	defer cleanup()
+
+	subject.limits = &VelocityLimits{
+		Limits: []VelocityLimit{{Name: "day", Period: 24 * time.Hour, MaxPence: 500}},
+	}
+	subject.policy.HoldOverLimit = true
+
+	if err := subject.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{"tx_heldfulfil", "tx_heldrefund", "tx_heldcancel"}
+	for _, id := range ids {
+		order := newTestOrder(id)
+		monzo.SetTransaction(order.Transaction)
+		if err := subject.ledger.Receive(&order); err != nil {
+			t.Fatal(err)
+		}
+		subject.Push(order.Id)
+	}
+	subject.Wait()
+
+	// An order whose reference was never read has no address to send Ether to
+	anonymous := newTestOrder("tx_heldanonymous")
+	anonymous.EthAddress = eth.Address{}
+	anonymous.SetError(CounterpartyMissingError("Counterparty data missing"))
+	monzo.SetTransaction(anonymous.Transaction)
+	if err := subject.ledger.Receive(&anonymous); err != nil {
+		t.Fatal(err)
+	}
+	subject.Push(anonymous.Id)
+	subject.Wait()
+
+	for _, id := range append(ids, anonymous.Id) {
+		waitForState(t, subject.ledger, id, OrderHeld)
+	}
+
+	handler := Operators{"alice": "secret"}.Require(HeldOrdersHandler(subject))
+	release := func(password string, form url.Values) int {
+		r := httptest.NewRequest("POST", "/admin/held", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth("alice", password)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	fulfil := url.Values{"id": {"tx_heldfulfil"}, "action": {ReleaseFulfil}, "note": {"known customer"}}
+	if status := release("wrong", fulfil); status != http.StatusUnauthorized {
+		t.Errorf("unauthenticated release status %d", status)
+	}
+	if status := release("secret", url.Values{"id": {"tx_heldfulfil"}, "action": {"approve"}}); status != http.StatusBadRequest {
+		t.Errorf("unknown action status %d", status)
+	}
+	for id, action := range map[string]string{"tx_heldfulfil": ReleaseFulfil, "tx_heldrefund": ReleaseRefund, "tx_heldcancel": ReleaseCancel} {
+		if status := release("secret", url.Values{"id": {id}, "action": {action}}); status != http.StatusOK {
+			t.Errorf("%s status %d", action, status)
+		}
+	}
+	if status := release("secret", fulfil); status != http.StatusBadRequest {
+		t.Errorf("released an order that is not held: %d", status)
+	}
+	if status := release("secret", url.Values{"id": {anonymous.Id}, "action": {ReleaseFulfil}}); status != http.StatusBadRequest {
+		t.Errorf("fulfilled an order with no address: %d", status)
+	}
+	subject.Wait()
+
+	fulfilled := waitForState(t, subject.ledger, "tx_heldfulfil", OrderBooksBalanced)
+	if len(fulfilled.HoldReleases) != 1 || fulfilled.HoldReleases[0].Operator != "alice" {
+		t.Errorf("releases %v", fulfilled.HoldReleases)
+	}
+	waitForState(t, subject.ledger, "tx_heldrefund", OrderRefunded)
+	waitForState(t, subject.ledger, "tx_heldcancel", OrderCancelled)
+
+	o := waitForState(t, subject.ledger, anonymous.Id, OrderHeld)
+	if len(o.HoldReleases) != 0 || coinbase.EthAccounts[eth.Address{}.String()].Sign() != 0 {
+		t.Errorf("releases %v", o.HoldReleases)
+	}
+}
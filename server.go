@@ -6,6 +6,7 @@ import (
 	"html/template"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -17,13 +18,89 @@ var monzoClient = Monzo{
 	nextDedupeId: time.Now().Unix(),
 }
 var coinbaseClient = Coinbase{}
+var ledger = Ledger{
+	dir: FileSystemRoot + "orders/",
+}
+var quotes = QuoteBook{
+	dir: QuoteDir,
+}
+var priceGuard = PriceGuard{
+	MaxDeviationPercent:       PriceMaxDeviationPercent,
+	Window:                    PriceReferenceWindow,
+	MaxSpreadPercent:          PriceMaxSpreadPercent,
+	MinDepthPence:             PriceMinDepthGBP * 100,
+	MaxSourceDeviationPercent: PriceMaxSourceDeviationPercent,
+	file:                      HaltFile,
+	historyFile:               PriceHistoryFile,
+}
+var maintenance = Maintenance{
+	file: MaintenanceFile,
+}
 var logic = Logic{
 	coinbase: &coinbaseClient,
 	monzo:    &monzoClient,
+	ledger:   &ledger,
+
+	maxSendFailures: SendEtherMaxFailures,
+
+	quotes:            &quotes,
+	quoteValidity:     QuoteValidity,
+	refundStaleQuotes: os.Getenv("StaleQuoteAction") == "refund",
+
+	guard:       &priceGuard,
+	maintenance: &maintenance,
+}
+var quoteLimiter = RateLimiter{
+	Max:    QuoteRateLimit,
+	Period: QuoteRatePeriod,
+}
+var globalQuoteLimiter = RateLimiter{
+	Max:    QuoteGlobalRateLimit,
+	Period: QuoteRatePeriod,
+}
+var velocityLimits = VelocityLimits{
+	Limits: []VelocityLimit{
+		{Name: "day", Period: 24 * time.Hour, MaxPence: DailyLimitGBP * 100},
+		{Name: "week", Period: 7 * 24 * time.Hour, MaxPence: WeeklyLimitGBP * 100},
+		{Name: "month", Period: 30 * 24 * time.Hour, MaxPence: MonthlyLimitGBP * 100},
+	},
+}
+var errorPolicy = ErrorPolicy{
+	HoldOverLimit:        os.Getenv("OverLimitAction") == "hold",
+	RefundFailedDelivery: os.Getenv("FailedDeliveryAction") == "refund",
+	RefundWhenHalted:     os.Getenv("HaltAction") == "refund",
+	RefundWhenPaused:     os.Getenv("PausedAction") == "refund",
+}
+var refundReview = RefundReviewPolicy{
+	AbovePence: RefundReviewAboveGBP * 100,
+}
+var queue = Queue{
+	ledger:      &ledger,
+	logic:       &logic,
+	workers:     QueueWorkers,
+	maxAttempts: QueueMaxAttempts,
+	backoff:     QueueRetryBackoff,
+	maxBackoff:  QueueMaxBackoff,
+
+	settledOnly:     os.Getenv("FulfilSettledOnly") == "true",
+	settlementCheck: SettlementCheckInterval,
+	withdrawalCheck: WithdrawalCheckInterval,
+	sweep:           OrderSweepInterval,
+	limits:          &velocityLimits,
+	policy:          &errorPolicy,
+	review:          &refundReview,
+
+	inventorySync: InventorySyncInterval,
+
+	maintenanceCheck: MaintenanceCheckInterval,
 }
 
 var nextAccessCode uint = 0
 
+var recordWebHooks = os.Getenv("RecordWebHooks") == "true"
+
+var operators = ParseOperators(os.Getenv("AdminOperators"))
+
 func logAndDelegate(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Println(r.Method, r.URL.Path, r.RemoteAddr, r.Referer(), r.UserAgent())
@@ -53,13 +130,24 @@ func renderTemplate(tmpl string, model interface{}, w http.ResponseWriter) {
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
-	vm := IndexViewModel{}
+	vm := IndexViewModel{
+		Paused:               maintenance.Paused() != nil,
+		QuoteValidityMinutes: int(logic.quoteValidity / time.Minute),
+		PartialFulfilment:    os.Getenv("PartialFulfilment") == "true",
+		DailyLimitGBP:        velocityLimits.MaxGBP("day"),
+		WeeklyLimitGBP:       velocityLimits.MaxGBP("week"),
+		MonthlyLimitGBP:      velocityLimits.MaxGBP("month"),
+	}
 
 	renderTemplate("index", vm, w)
 }
 
 func monzoWebhookHandler(w http.ResponseWriter, r *http.Request) {
-	HandleError(ProcessOrder(w, r))
+	if recordWebHooks {
+		HandleError(RecordWebHook(WebHookRecordingDir, r))
+	}
+
+	HandleError(ProcessOrder(&queue, w, r))
 }
 
 type GetAccessCodeResponse struct {
@@ -79,9 +167,9 @@ func getAccessCodeHandler(w http.ResponseWriter, r *http.Request) {
 
 	if IsValidAddress(address) {
 
-		accessCode := time.Now().Unix()
+		accessCode := NewAccessCode(time.Now())
 
-		filename := fmt.Sprintf("%saccess-codes/%d.txt", FileSystemRoot, accessCode)
+		filename := fmt.Sprintf("%saccess-codes/%s.txt", FileSystemRoot, accessCode)
 
 		err := ioutil.WriteFile(filename, []byte(address), 0644)
 
@@ -91,9 +179,9 @@ func getAccessCodeHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		response.AccessCode = fmt.Sprintf("%d", accessCode)
+		response.AccessCode = accessCode
 
-		log.Printf("Issued access code %d for address %s", accessCode, address)
+		log.Printf("Issued access code %s for address %s", accessCode, address)
 
 	} else {
 		log.Println("Cannot issue access code: Invalid ethereum address")
@@ -111,6 +199,83 @@ func getAccessCodeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(json)
 }
 
+type GetQuoteResponse struct {
+	Error       string `json:"error"`
+	AmountPence int    `json:"amount_pence"`
+	EtherAmount string `json:"ether_amount"`
+	Expires     string `json:"expires"`
+}
+
+func getQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	now := time.Now()
+	if !quoteLimiter.Allow(host, now) || !globalQuoteLimiter.Allow("", now) {
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	accessCode := r.FormValue("access-code")
+	amountPence, err := strconv.Atoi(r.FormValue("amount-pence"))
+
+	response := GetQuoteResponse{}
+
+	if err != nil {
+		response.Error = "Invalid amount"
+	} else if !IsValidAccessCode(accessCode) {
+		response.Error = "Unknown access code"
+	} else if _, err = AccessCodeToEthereumAddress(accessCode); err != nil {
+		response.Error = "Unknown access code"
+	} else {
+		quote, err := logic.Quote(accessCode, amountPence, time.Now())
+
+		switch {
+		case KindOf(err) == KindCustomer:
+			response.Error = err.Error()
+		case err != nil:
+			log.Println("Failed to quote: " + err.Error())
+			response.Error = "Sorry, we cannot give you a quote right now"
+		default:
+			response.AmountPence = quote.AmountPence
+			response.EtherAmount = quote.EtherAmount.Ether()
+			response.Expires = quote.Expires.Format(time.RFC3339)
+
+			log.Printf("Quoted %s ETH for %d to access code %s", quote.EtherAmount.Ether(), amountPence, accessCode)
+		}
+	}
+
+	json, err := json.Marshal(response)
+
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(json)
+}
+
+// etherSetting reads an amount of Ether from the environment, or uses the default
+func etherSetting(name string, def string) Wei {
+	v := os.Getenv(name)
+	if v == "" {
+		v = def
+	}
+
+	w, err := ParseEther(v)
+	if err != nil {
+		panic(name + ": " + err.Error())
+	}
+	return w
+}
+
 func init() {
 	for _, tmpl := range []string{"index"} {
 		filename := FileSystemRoot + "html/" + tmpl + ".html"
@@ -123,18 +288,143 @@ func init() {
 	}
 
 	coinbaseClient.Init()
+
+	// Refunds are paid out automatically when a payments API is configured
+	if os.Getenv("BankApiUrl") != "" {
+		logic.bank = &HttpBank{
+			root:  os.Getenv("BankApiUrl"),
+			token: os.Getenv("BankApiToken"),
+		}
+	}
+
+	err := ledger.Init()
+	if err != nil {
+		panic(err)
+	}
+
+	if v := os.Getenv("RefundReviewAbovePence"); v != "" {
+		refundReview.AbovePence, err = strconv.Atoi(v)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if v := os.Getenv("SendEtherMaxFailures"); v != "" {
+		logic.maxSendFailures, err = strconv.Atoi(v)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	for i, name := range []string{"DailyLimitGBP", "WeeklyLimitGBP", "MonthlyLimitGBP"} {
+		if v := os.Getenv(name); v != "" {
+			gbp, err := strconv.Atoi(v)
+			if err != nil {
+				panic(err)
+			}
+			velocityLimits.Limits[i].MaxPence = gbp * 100
+		}
+	}
+
+	fees, err := LoadFeeSchedule(FeeScheduleFile)
+	if err != nil {
+		panic(err)
+	}
+	logic.fees = &fees
+
+	queue.inventoryTolerance = etherSetting("InventoryToleranceEther", InventoryToleranceEther)
+	logic.purchaseBuffer = etherSetting("InventoryBufferEther", InventoryBufferEther)
+	logic.minPurchase = etherSetting("CoinbaseMinOrderEther", CoinbaseMinOrderEther)
+
+	// Inventory is only managed in the background if a band is configured
+	if os.Getenv("InventoryHighEther") != "" {
+		queue.band = &InventoryBand{
+			Low:        etherSetting("InventoryLowEther", "0"),
+			High:       etherSetting("InventoryHighEther", ""),
+			SellExcess: os.Getenv("InventorySellExcess") == "true",
+			DryRun:     os.Getenv("InventoryDryRun") == "true",
+		}
+		if queue.band.High.Cmp(queue.band.Low) < 0 {
+			panic("InventoryHighEther is below InventoryLowEther")
+		}
+		queue.rebalance = InventoryRebalanceInterval
+	}
+
+	err = quotes.Init()
+	if err != nil {
+		panic(err)
+	}
+
+	if v := os.Getenv("QuoteValidityMinutes"); v != "" {
+		minutes, err := strconv.Atoi(v)
+		if err != nil {
+			panic(err)
+		}
+		logic.quoteValidity = time.Duration(minutes) * time.Minute
+	}
+
+	switch os.Getenv("SecondaryPriceSource") {
+	case "":
+	case "kraken":
+		priceGuard.secondary = &KrakenPriceSource{root: KrakenApiRoot}
+	default:
+		panic("Unknown SecondaryPriceSource: " + os.Getenv("SecondaryPriceSource"))
+	}
+
+	err = priceGuard.Init()
+	if err != nil {
+		panic(err)
+	}
+
+	err = refundReview.LoadFlagged(FlaggedCounterpartiesFile)
+	if err != nil {
+		panic(err)
+	}
+
+	if recordWebHooks {
+		err = os.MkdirAll(WebHookRecordingDir, 0755)
+		if err != nil {
+			panic(err)
+		}
+	}
 }
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		err := Replay(os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && (os.Args[1] == "pause" || os.Args[1] == "resume") {
+		err := PauseCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err := queue.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	httpsMux := http.NewServeMux()
 
 	httpsMux.HandleFunc("/favicon.ico", faviconHandler)
 	httpsMux.HandleFunc("/", indexHandler)
 	httpsMux.HandleFunc("/get-access-code", getAccessCodeHandler)
+	httpsMux.HandleFunc("/get-quote", getQuoteHandler)
 	httpsMux.HandleFunc("/monzo-"+os.Getenv("WebHookSecretUrlPart"), monzoWebhookHandler)
 	httpsMux.HandleFunc("/monzo-login", monzoClient.HandleLogin)
 	httpsMux.HandleFunc("/monzo-oath-callback", monzoClient.HandleOauth2Callback)
+	httpsMux.HandleFunc("/admin/refunds", operators.Require(RefundReviewHandler(&queue)))
+	httpsMux.HandleFunc("/admin/held", operators.Require(HeldOrdersHandler(&queue)))
+	httpsMux.HandleFunc("/admin/price-guard", operators.Require(PriceGuardHandler(&queue, &priceGuard)))
+	httpsMux.HandleFunc("/admin/maintenance", operators.Require(MaintenanceHandler(&queue, &maintenance)))
 	httpsMux.Handle("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir(FileSystemRoot+"js"))))
 	httpsMux.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir(FileSystemRoot+"css"))))
 	httpsMux.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir(FileSystemRoot+"img"))))
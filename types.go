@@ -7,18 +7,131 @@ import (
 )
 
 type IndexViewModel struct {
+	// Shows a maintenance banner
+	Paused bool
+
+	// How long a quote is honoured for
+	QuoteValidityMinutes int
+
+	// Payments over the maximum are fulfilled up to it rather than refunded
+	PartialFulfilment bool
+
+	// How much each customer can spend over each period
+	DailyLimitGBP   int
+	WeeklyLimitGBP  int
+	MonthlyLimitGBP int
 }
 
 type Order struct {
+	Id            string
 	SortCode      string
 	AccountNumber string
 	Currency      string
 	Amount        int
 	EthAddress    eth.Address
+	AccessCode    string
+
+	// The transaction exactly as it arrived in the webhook
+	Transaction MonzoWebHookTransaction
+
+	// How the payment reference was interpreted to find EthAddress
+	ReferenceNotes []string
+
+	// A payment over the maximum order size may be split into two legs, one
+	// fulfilling the maximum and one refunding the excess
+	Excess        int
+	ExcessOrderId string
+	ParentId      string
+
+	// Set once the order has been priced. Commission is the total of the fees.
+	// EtherRoundedOff is what the payment bought beyond EtherAmount, which is
+	// rounded down to what Coinbase sends.
+	EtherPrice      float64
+	Fees            *FeeBreakdown `json:",omitempty"`
+	Commission      int
+	EtherAmount     Wei
+	EtherRoundedOff Wei
+	Quoted          bool
+
+	// Ether bought on Coinbase while fulfilling the order. The last purchase
+	// may not have finished.
+	Purchases []Fill
+
+	// The moves between Monzo pots made for the order, so that a retry never
+	// makes one twice
+	PotMoves []string
+
+	// The number of times sending the Ether has failed
+	SendFailures int
+
+	// Set once the Ether has been withdrawn from Coinbase. The transaction
+	// hash and the network fee Coinbase charged are set once the withdrawal
+	// has completed.
+	WithdrawalId  string
+	TxHash        string
+	WithdrawalFee Wei
+
+	// The reason the order is being refunded or held
+	Error      string
+	ErrorKind  ErrorKind
+	ReasonCode string
+
+	// Set once an operator has reviewed the refund
+	RefundReview *RefundDecision `json:",omitempty"`
+
+	// Set once the refund has been paid out to the customer's bank account
+	RefundPayeeId   string
+	RefundPaymentId string
+	RefundReference string
+
+	// Set if something happened to the order that an operator must deal with
+	Incident string
+
+	// What operators decided each time the order was held
+	HoldReleases []HoldRelease
+
+	State       OrderState
+	Transitions []OrderTransition
+}
+
+func (o *Order) SetError(err error) {
+	e := AsOrderError(err)
+	o.Error = e.Message
+	o.ErrorKind = e.Kind
+	o.ReasonCode = e.Reason
+}
+
+// Err returns the error recorded on the order, if any
+func (o *Order) Err() error {
+	if o.Error == "" {
+		return nil
+	}
+
+	// Orders recorded before errors had kinds were only ever refunded
+	kind := o.ErrorKind
+	if kind == "" {
+		kind = KindCustomer
+	}
+
+	return &OrderError{Kind: kind, Reason: o.ReasonCode, Message: o.Error}
+}
+
+// LegAmount is the part of the payment that this leg of the order deals with
+func (o *Order) LegAmount() int {
+	return o.Amount - o.Excess
+}
+
+// RefundAmount is what the customer gets back, less any fee the reviewing
+// operator deducted
+func (o *Order) RefundAmount() int {
+	if o.RefundReview != nil {
+		return o.LegAmount() - o.RefundReview.FeePence
+	}
+	return o.LegAmount()
 }
 
 func (o Order) String() string {
-	return fmt.Sprintf("{ %s %s %s %d %s }", o.SortCode, o.AccountNumber, o.Currency, o.Amount, o.EthAddress.Hex())
+	return fmt.Sprintf("{ %s %s %s %s %s %d %s }", o.Id, o.State, o.SortCode, o.AccountNumber, o.Currency, o.Amount, o.EthAddress.Hex())
 }
 
 type CoinbaseWithdrawCryptoParams struct {
@@ -32,3 +145,31 @@ type CoinbaseWithdrawCryptoResult struct {
 	Amount   string `json:"amount"`
 	Currency string `json:"currency"`
 }
+
+// CoinbaseTransfer is a deposit or withdrawal. The times are empty until the
+// transfer reaches that point.
+type CoinbaseTransfer struct {
+	Id          string                  `json:"id"`
+	Type        string                  `json:"type"`
+	CreatedAt   string                  `json:"created_at"`
+	CompletedAt string                  `json:"completed_at"`
+	CanceledAt  string                  `json:"canceled_at"`
+	Amount      string                  `json:"amount"`
+	Details     CoinbaseTransferDetails `json:"details"`
+}
+
+type CoinbaseTransferDetails struct {
+	SentToAddress         string `json:"sent_to_address"`
+	CryptoTransactionHash string `json:"crypto_transaction_hash"`
+	Fee                   string `json:"fee"`
+}
+
+// CoinbaseAccount is read with strings rather than go-gdax's floats so that
+// balances are exact
+type CoinbaseAccount struct {
+	Id        string `json:"id"`
+	Currency  string `json:"currency"`
+	Balance   string `json:"balance"`
+	Available string `json:"available"`
+	Hold      string `json:"hold"`
+}